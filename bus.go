@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/ibllex/go-queue/internal"
 )
 
 var (
@@ -42,6 +44,8 @@ func SetDefault(name string) {
 type DispatchOption struct {
 	Queue string
 	Delay time.Duration
+	// Priority of the messages, it is ignored by backends without priority support
+	Priority uint8
 }
 
 // Dispatch an message to queue
@@ -55,14 +59,47 @@ func Dispatch(opt *DispatchOption, messages ...interface{}) error {
 		opt.Queue = defaultQueue
 	}
 
+	envelopes := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		e := envelope(msg)
+		if e.Priority == 0 {
+			e.Priority = opt.Priority
+		}
+		envelopes[i] = e
+	}
+
+	if f := faking(); f != nil {
+		for _, e := range envelopes {
+			e := e.(*Envelope)
+			f.capture(opt, e.Type, e.Body, e.Properties)
+		}
+		return nil
+	}
+
 	q, err := Get(opt.Queue)
 	if err != nil {
 		return err
 	}
 
+	// the properties would be encoded along with the body by the other queues
+	if p, ok := q.(PropertiesPublisher); !ok || !p.CarriesProperties() {
+		envelopes = messages
+	}
+
 	if opt.Delay > 0 {
-		return q.Later(opt.Delay, messages...)
+		return q.Later(opt.Delay, envelopes...)
+	}
+
+	return q.Publish(envelopes...)
+}
+
+// envelope wraps the message and records its type name,
+// so that the consumer can route it without guessing
+func envelope(msg interface{}) *Envelope {
+	body, props := Unwrap(msg)
+	if props.Type == "" && body != nil {
+		props.Type = internal.NameOf(body)
 	}
 
-	return q.Publish(messages...)
+	return &Envelope{Properties: props, Body: body}
 }
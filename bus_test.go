@@ -0,0 +1,40 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// plainQueue records the published messages, it does not carry properties
+type plainQueue struct {
+	published []interface{}
+}
+
+func (q *plainQueue) Name() string { return "plain" }
+
+func (q *plainQueue) Size() int { return len(q.published) }
+
+func (q *plainQueue) Consumer(opt *queue.ConsumerOption) (*queue.Consumer, error) {
+	return nil, nil
+}
+
+func (q *plainQueue) Publish(messages ...interface{}) error {
+	q.published = append(q.published, messages...)
+	return nil
+}
+
+func (q *plainQueue) Later(delay time.Duration, messages ...interface{}) error {
+	return q.Publish(messages...)
+}
+
+func TestDispatchPlainQueue(t *testing.T) {
+	q := &plainQueue{}
+	queue.Add(q)
+
+	// queues which do not carry properties get the messages as they are
+	assert.Nil(t, queue.Dispatch(&queue.DispatchOption{Queue: "plain", Priority: 3}, &OrderEvent{ID: 1}, "hello"))
+	assert.Equal(t, []interface{}{&OrderEvent{ID: 1}, "hello"}, q.published)
+}
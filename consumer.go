@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ibllex/go-queue/internal"
 	"github.com/ibllex/go-queue/internal/logger"
@@ -50,6 +51,58 @@ type ConsumerOption struct {
 
 	// Message handler
 	Handler Handler
+
+	// StartFrom is where the consumer starts reading a replayable queue,
+	// e.g. a RabbitMQ stream. Default is the next published message,
+	// backends which delete consumed messages ignore it
+	StartFrom Offset
+}
+
+//
+// Offset
+//
+
+type OffsetKind int
+
+const (
+	// OffsetNext starts from the next published message
+	OffsetNext OffsetKind = iota
+	// OffsetFirst starts from the first message kept by the queue
+	OffsetFirst
+	// OffsetLast starts from the last message, or the last chunk of messages
+	OffsetLast
+	// OffsetAt starts from the message at the position Offset.Value
+	OffsetAt
+	// OffsetTimestamp starts from the first message published at or after Offset.Timestamp
+	OffsetTimestamp
+)
+
+// Offset is a position in a replayable queue
+type Offset struct {
+	Kind      OffsetKind
+	Value     int64
+	Timestamp time.Time
+}
+
+// FromFirst replays all the messages kept by the queue
+func FromFirst() Offset {
+	return Offset{Kind: OffsetFirst}
+}
+
+// FromLast starts from the last message
+func FromLast() Offset {
+	return Offset{Kind: OffsetLast}
+}
+
+// FromOffset starts from the message at the position,
+// e.g. the one after the last processed message
+func FromOffset(offset int64) Offset {
+	return Offset{Kind: OffsetAt, Value: offset}
+}
+
+// FromTimestamp starts from the first message published at or after t
+func FromTimestamp(t time.Time) Offset {
+	return Offset{Kind: OffsetTimestamp, Timestamp: t}
 }
 
 // consumer reserves messages from the queue, processes them,
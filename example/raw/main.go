@@ -17,8 +17,11 @@ type Task struct {
 	Params interface{}
 }
 
-func handler(name string) func(queue.Message) {
-	return func(m queue.Message) {
+func handler(name string) queue.Handler {
+	// Router distributes messages to handlers according to the message type,
+	// which is recorded by queue.Dispatch at publish time
+	r := queue.NewRouter()
+	r.Register(&Task{}, queue.H(func(m queue.Message) {
 		// Decode message
 		var t Task
 		m.Unmarshal(&t)
@@ -29,7 +32,15 @@ func handler(name string) func(queue.Message) {
 		// and the rejected message will be returned to the message queue again
 		m.Ack()
 		time.Sleep(1 * time.Second)
-	}
+	}))
+
+	// Messages of unknown types are passed to the fallback handler
+	r.Fallback(queue.H(func(m queue.Message) {
+		fmt.Printf("%s skipped: %s\n", name, queue.PropertiesOf(m).Type)
+		m.Ack()
+	}))
+
+	return r
 }
 
 func startConsumer(name string) {
@@ -37,7 +48,7 @@ func startConsumer(name string) {
 	q, _ := queue.Get(route)
 	c, err := q.Consumer(&queue.ConsumerOption{
 		ID:           name,
-		Handler:      queue.H(handler(name)),
+		Handler:      handler(name),
 		MaxNumWorker: 2,
 	})
 
@@ -0,0 +1,222 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ibllex/go-queue/internal"
+)
+
+var (
+	fakeMu sync.RWMutex
+	fake   *FakeQueue
+)
+
+// TestingT is the subset of *testing.T used by the assertions of FakeQueue
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Dispatched is a message captured by FakeQueue
+type Dispatched struct {
+	// Queue is the name of the queue which the message is dispatched on
+	Queue string
+	Delay time.Duration
+	// Name is the task name or the message type
+	Name string
+	// Message is the dispatched task or message body
+	Message    interface{}
+	Properties Properties
+}
+
+// FakeQueue captures the messages and tasks dispatched by Dispatch and DispatchTask
+// instead of publishing them, nothing is published to any queue until Restore is called.
+// Delays are recorded but never waited for
+type FakeQueue struct {
+	mu         sync.Mutex
+	dispatched []*Dispatched
+}
+
+// Fake starts capturing dispatched messages and tasks of all queues,
+// call Restore when the test is done
+//
+//	f := queue.Fake()
+//	defer f.Restore()
+func Fake() *FakeQueue {
+	f := &FakeQueue{}
+
+	fakeMu.Lock()
+	fake = f
+	fakeMu.Unlock()
+
+	return f
+}
+
+// Restore stops capturing, messages are published to the queues again
+func (f *FakeQueue) Restore() {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+
+	if fake == f {
+		fake = nil
+	}
+}
+
+func faking() *FakeQueue {
+	fakeMu.RLock()
+	defer fakeMu.RUnlock()
+
+	return fake
+}
+
+func (f *FakeQueue) capture(opt *DispatchOption, name string, msg interface{}, props Properties) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dispatched = append(f.dispatched, &Dispatched{
+		Queue:      opt.Queue,
+		Delay:      opt.Delay,
+		Name:       name,
+		Message:    msg,
+		Properties: props,
+	})
+}
+
+// All returns everything captured, in dispatching order
+func (f *FakeQueue) All() []*Dispatched {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*Dispatched(nil), f.dispatched...)
+}
+
+// Dispatched returns the captured messages of the type,
+// which is given as a value of the type or as its name
+func (f *FakeQueue) Dispatched(v interface{}, predicate ...func(d *Dispatched) bool) []*Dispatched {
+	var matched []*Dispatched
+	for _, d := range f.All() {
+		if d.is(v) && d.satisfies(predicate) {
+			matched = append(matched, d)
+		}
+	}
+
+	return matched
+}
+
+// AssertDispatched asserts that a message of the type has been dispatched,
+// which satisfies all the predicates
+func (f *FakeQueue) AssertDispatched(t TestingT, v interface{}, predicate ...func(d *Dispatched) bool) bool {
+	if len(f.Dispatched(v, predicate...)) == 0 {
+		t.Errorf("expected %s to be dispatched, but it was not", nameOf(v))
+		return false
+	}
+
+	return true
+}
+
+// AssertDispatchedTimes asserts that messages of the type have been dispatched n times
+func (f *FakeQueue) AssertDispatchedTimes(t TestingT, v interface{}, n int) bool {
+	if count := len(f.Dispatched(v)); count != n {
+		t.Errorf("expected %s to be dispatched %d times, but it was dispatched %d times", nameOf(v), n, count)
+		return false
+	}
+
+	return true
+}
+
+// AssertNotDispatched asserts that no message of the type satisfying all the predicates
+// has been dispatched
+func (f *FakeQueue) AssertNotDispatched(t TestingT, v interface{}, predicate ...func(d *Dispatched) bool) bool {
+	if count := len(f.Dispatched(v, predicate...)); count > 0 {
+		t.Errorf("expected %s not to be dispatched, but it was dispatched %d times", nameOf(v), count)
+		return false
+	}
+
+	return true
+}
+
+// AssertDispatchedOn asserts that a message of the type has been dispatched on the queue
+func (f *FakeQueue) AssertDispatchedOn(t TestingT, queue string, v interface{}) bool {
+	if len(f.Dispatched(v, func(d *Dispatched) bool { return d.Queue == queue })) == 0 {
+		t.Errorf("expected %s to be dispatched on queue %s, but it was not", nameOf(v), queue)
+		return false
+	}
+
+	return true
+}
+
+// AssertNothingDispatched asserts that nothing has been dispatched
+func (f *FakeQueue) AssertNothingDispatched(t TestingT) bool {
+	if count := len(f.All()); count > 0 {
+		t.Errorf("expected nothing to be dispatched, but %d messages were dispatched", count)
+		return false
+	}
+
+	return true
+}
+
+// Run handles the captured tasks of the type synchronously in dispatching order,
+// they are removed from the captured messages. Tasks dispatched while running
+// are captured, so that chained tasks can be run step by step.
+// The first error returned by the tasks is returned after running the others
+func (f *FakeQueue) Run(v interface{}) (err error) {
+	return f.run(func(d *Dispatched) bool { return d.is(v) })
+}
+
+// RunAll handles all captured tasks synchronously in dispatching order, see Run
+func (f *FakeQueue) RunAll() error {
+	return f.run(func(d *Dispatched) bool { return true })
+}
+
+func (f *FakeQueue) run(match func(d *Dispatched) bool) (err error) {
+	var tasks []Task
+
+	f.mu.Lock()
+	kept := f.dispatched[:0]
+	for _, d := range f.dispatched {
+		if task, ok := d.Message.(Task); ok && match(d) {
+			tasks = append(tasks, task)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	f.dispatched = kept
+	f.mu.Unlock()
+
+	for _, task := range tasks {
+		if e := task.Handle(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// is reports whether the message is of the type given as a value or a name
+func (d *Dispatched) is(v interface{}) bool {
+	name := nameOf(v)
+	return d.Name == name || (d.Message != nil && internal.NameOf(d.Message) == name)
+}
+
+func (d *Dispatched) satisfies(predicate []func(d *Dispatched) bool) bool {
+	for _, p := range predicate {
+		if !p(d) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func nameOf(v interface{}) string {
+	if name, ok := v.(string); ok {
+		return name
+	}
+
+	if v == nil {
+		return fmt.Sprint(v)
+	}
+
+	return internal.NameOf(v)
+}
@@ -0,0 +1,122 @@
+package queue_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/stretchr/testify/assert"
+)
+
+type SendEmail struct {
+	To string
+}
+
+func (t *SendEmail) Handle() error {
+	sent = append(sent, t.To)
+	if t.To == "" {
+		return fmt.Errorf("no recipient")
+	}
+
+	return queue.DispatchTask(&SendReceipt{To: t.To})
+}
+
+func (t *SendEmail) OnQueue() string {
+	return "mail"
+}
+
+func (t *SendEmail) Delay() time.Duration {
+	return time.Hour
+}
+
+type SendReceipt struct {
+	To string
+}
+
+func (t *SendReceipt) Handle() error {
+	return nil
+}
+
+var sent []string
+
+// recorder records the failures of assertions
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestFake(t *testing.T) {
+
+	t.Run("capture", func(t *testing.T) {
+		f := queue.Fake()
+		defer f.Restore()
+
+		f.AssertNothingDispatched(t)
+
+		// the queues are not required to be registered
+		assert.Nil(t, queue.DispatchTask(&SendEmail{To: "alice"}))
+		assert.Nil(t, queue.Dispatch(&queue.DispatchOption{Queue: "events", Priority: 3}, "signed up"))
+
+		f.AssertDispatched(t, &SendEmail{})
+		f.AssertDispatched(t, &SendEmail{}, func(d *queue.Dispatched) bool {
+			return d.Message.(*SendEmail).To == "alice" && d.Delay == time.Hour
+		})
+		f.AssertDispatchedOn(t, "mail", &SendEmail{})
+		f.AssertDispatchedTimes(t, &SendEmail{}, 1)
+		f.AssertNotDispatched(t, &SendReceipt{})
+		f.AssertDispatchedOn(t, "events", "string")
+
+		events := f.Dispatched("string")
+		assert.Len(t, events, 1)
+		assert.Equal(t, "signed up", events[0].Message)
+		assert.Equal(t, uint8(3), events[0].Properties.Priority)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		f := queue.Fake()
+		defer f.Restore()
+
+		queue.DispatchTask(&SendEmail{To: "alice"})
+
+		r := &recorder{}
+		assert.False(t, f.AssertDispatched(r, &SendReceipt{}))
+		assert.False(t, f.AssertDispatched(r, &SendEmail{}, func(d *queue.Dispatched) bool {
+			return d.Message.(*SendEmail).To == "bob"
+		}))
+		assert.False(t, f.AssertNotDispatched(r, &SendEmail{}))
+		assert.False(t, f.AssertDispatchedOn(r, "default", &SendEmail{}))
+		assert.False(t, f.AssertDispatchedTimes(r, &SendEmail{}, 2))
+		assert.False(t, f.AssertNothingDispatched(r))
+		assert.Len(t, r.errors, 6)
+	})
+
+	t.Run("run", func(t *testing.T) {
+		f := queue.Fake()
+		defer f.Restore()
+		sent = nil
+
+		queue.DispatchTask(&SendEmail{To: "alice"})
+		queue.DispatchTask(&SendEmail{To: "bob"})
+
+		assert.Nil(t, f.Run(&SendEmail{}))
+		assert.Equal(t, []string{"alice", "bob"}, sent)
+		f.AssertNotDispatched(t, &SendEmail{})
+		f.AssertDispatchedTimes(t, &SendReceipt{}, 2)
+
+		queue.DispatchTask(&SendEmail{})
+		assert.NotNil(t, f.RunAll())
+		f.AssertNothingDispatched(t)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		f := queue.Fake()
+		f.Restore()
+
+		assert.NotNil(t, queue.Dispatch(&queue.DispatchOption{Queue: "unknown"}, "hello"))
+		f.AssertNothingDispatched(t)
+	})
+}
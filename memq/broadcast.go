@@ -0,0 +1,108 @@
+package memq
+
+import (
+	"context"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal"
+)
+
+// Subscription receives a copy of every message published to a broadcast queue
+type Subscription struct {
+	q      *Queue
+	id     string
+	buffer *buffer
+	policy OverflowPolicy
+	// consumer subscriptions are created by Worker, they are removed
+	// from the queue when their Daemon returns
+	consumer bool
+}
+
+func (s *Subscription) Name() string {
+	return s.q.name
+}
+
+// Size returns the number of messages waiting in the subscription
+func (s *Subscription) Size() int {
+	return s.buffer.len()
+}
+
+func (s *Subscription) Daemon(ctx context.Context, handler queue.HandlerFunc) error {
+	if s.consumer {
+		// a restarted consumer subscribes again
+		s.q.subsMu.Lock()
+		s.q.subs[s.id] = s
+		s.q.subsMu.Unlock()
+
+		defer s.Close()
+	}
+
+	return s.q.daemon(ctx, s.buffer, handler)
+}
+
+// Close removes the subscription from the queue,
+// the messages waiting in it are discarded
+func (s *Subscription) Close() {
+	s.q.subsMu.Lock()
+	delete(s.q.subs, s.id)
+	s.q.subsMu.Unlock()
+
+	// unblock the publishers waiting for room in the subscription
+	s.buffer.clear()
+}
+
+// subscribed reports whether the subscription still receives messages
+func (s *Subscription) subscribed() bool {
+	s.q.subsMu.RLock()
+	defer s.q.subsMu.RUnlock()
+
+	_, ok := s.q.subs[s.id]
+	return ok
+}
+
+// Subscribe creates a subscription with its own overflow policy,
+// use queue.NewConsumer to consume it. SpillToDisk is not supported,
+// it is treated as Block
+func (q *Queue) Subscribe(policy OverflowPolicy) *Subscription {
+	s := &Subscription{
+		q:      q,
+		id:     internal.RandomString(16),
+		buffer: newBuffer(q.opt.BufferSize),
+		policy: policy,
+	}
+
+	q.subsMu.Lock()
+	defer q.subsMu.Unlock()
+
+	q.subs[s.id] = s
+	return s
+}
+
+func (q *Queue) subscriptions() []*Subscription {
+	q.subsMu.RLock()
+	defer q.subsMu.RUnlock()
+
+	subs := make([]*Subscription, 0, len(q.subs))
+	for _, s := range q.subs {
+		subs = append(subs, s)
+	}
+
+	return subs
+}
+
+// broadcast delivers a copy of the message to every subscription,
+// messages published without subscriptions are discarded.
+// The first error is returned after delivering to the other subscriptions
+func (q *Queue) broadcast(m *Message) (err error) {
+	for _, s := range q.subscriptions() {
+		c := m.redelivery()
+		c.id = internal.RandomString(16)
+		c.sub = s
+
+		if e := q.push(s.buffer, s.policy, c); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
@@ -0,0 +1,252 @@
+package memq
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// buffer is a bounded priority queue of messages,
+// messages with the same priority are delivered in publishing order
+type buffer struct {
+	mu    sync.Mutex
+	items messageHeap
+	seq   uint64
+
+	// slots limits the number of buffered messages
+	slots chan struct{}
+	// ready is signaled when there are messages available
+	ready chan struct{}
+}
+
+// push adds the message to the buffer, it blocks when the buffer is full
+func (b *buffer) push(m *Message) {
+	b.slots <- struct{}{}
+	b.add(m)
+}
+
+// tryPush adds the message to the buffer unless it is full
+func (b *buffer) tryPush(m *Message) bool {
+	select {
+	case b.slots <- struct{}{}:
+		b.add(m)
+		return true
+	default:
+		return false
+	}
+}
+
+// pushTimeout adds the message to the buffer,
+// it blocks up to timeout when the buffer is full
+func (b *buffer) pushTimeout(m *Message, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		b.add(m)
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// replaceOldest removes the earliest published message to make room for m,
+// it returns nil without adding m if there is nothing to remove
+func (b *buffer) replaceOldest(m *Message) *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.items.Len() == 0 {
+		return nil
+	}
+
+	oldest := 0
+	for i, it := range b.items {
+		if it.seq < b.items[oldest].seq {
+			oldest = i
+		}
+	}
+
+	// the slot of the removed message is taken over by m,
+	// a forced message holds no slot, so neither does m
+	removed := heap.Remove(&b.items, oldest).(*item)
+	b.seq++
+	heap.Push(&b.items, &item{msg: m, seq: b.seq, forced: removed.forced})
+
+	return removed.msg
+}
+
+// force adds the message even if the buffer is full, for the messages which have
+// already been accepted by the queue, e.g. requeued ones
+func (b *buffer) force(m *Message) {
+	b.insert(m, true)
+}
+
+func (b *buffer) add(m *Message) {
+	b.insert(m, false)
+}
+
+func (b *buffer) insert(m *Message, forced bool) {
+	b.mu.Lock()
+	b.seq++
+	heap.Push(&b.items, &item{msg: m, seq: b.seq, forced: forced})
+	b.mu.Unlock()
+
+	b.signal()
+}
+
+// release frees the slot taken by the item
+func (b *buffer) release(it *item) {
+	if !it.forced {
+		<-b.slots
+	}
+}
+
+// pop takes the message with the highest priority,
+// it blocks until a message is available or the context is done
+func (b *buffer) pop(ctx context.Context) *Message {
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		b.mu.Lock()
+		if b.items.Len() > 0 {
+			it := heap.Pop(&b.items).(*item)
+			remains := b.items.Len()
+			b.mu.Unlock()
+
+			b.release(it)
+			if remains > 0 {
+				// wake up other waiting consumers
+				b.signal()
+			}
+
+			return it.msg
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-b.ready:
+		}
+	}
+}
+
+// list returns the buffered messages in delivery order
+func (b *buffer) list() []*Message {
+	b.mu.Lock()
+	items := make(messageHeap, len(b.items))
+	copy(items, b.items)
+	b.mu.Unlock()
+
+	sort.Sort(items)
+
+	messages := make([]*Message, len(items))
+	for i, it := range items {
+		messages[i] = it.msg
+	}
+
+	return messages
+}
+
+// remove takes the message with the given id out of the buffer,
+// it returns nil if there is no such message
+func (b *buffer) remove(id string) *Message {
+	b.mu.Lock()
+	var removed *item
+	for i, it := range b.items {
+		if it.msg.id == id {
+			removed = heap.Remove(&b.items, i).(*item)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	if removed == nil {
+		return nil
+	}
+
+	b.release(removed)
+	return removed.msg
+}
+
+// clear takes all messages out of the buffer
+func (b *buffer) clear() []*Message {
+	b.mu.Lock()
+	items := b.items
+	b.items = nil
+	b.mu.Unlock()
+
+	messages := make([]*Message, len(items))
+	for i, it := range items {
+		b.release(it)
+		messages[i] = it.msg
+	}
+
+	return messages
+}
+
+func (b *buffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.items.Len()
+}
+
+func (b *buffer) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+func newBuffer(size int) *buffer {
+	return &buffer{
+		slots: make(chan struct{}, size),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+//
+// Priority heap
+//
+
+type item struct {
+	msg *Message
+	seq uint64
+	// forced items do not take a slot
+	forced bool
+}
+
+type messageHeap []*item
+
+func (h messageHeap) Len() int { return len(h) }
+
+func (h messageHeap) Less(i, j int) bool {
+	pi, pj := h[i].msg.props.Priority, h[j].msg.props.Priority
+	if pi != pj {
+		return pi > pj
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h messageHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *messageHeap) Push(x interface{}) {
+	*h = append(*h, x.(*item))
+}
+
+func (h *messageHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return it
+}
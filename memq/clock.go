@@ -0,0 +1,133 @@
+package memq
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the time for the delay scheduler,
+// it can be replaced to control time in tests, see MockClock
+type Clock interface {
+	Now() time.Time
+	// NewTimerAt creates a timer firing at t, the deadline is absolute so a clock
+	// moved between reading Now and creating the timer does not delay it
+	NewTimerAt(t time.Time) Timer
+}
+
+// Timer is a single event created by Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+//
+// Real clock
+//
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimerAt(t time.Time) Timer {
+	return realTimer{time.NewTimer(time.Until(t))}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+//
+// Mock clock
+//
+
+// MockClock is a Clock which only moves forward when told to
+type MockClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+// Now returns the current time of the clock
+func (c *MockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTimerAt creates a timer firing when the clock has been moved to until
+func (c *MockClock) NewTimerAt(until time.Time) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &mockTimer{
+		c:     c,
+		ch:    make(chan time.Time, 1),
+		until: until,
+	}
+
+	if !until.After(c.now) {
+		t.ch <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+
+	return t
+}
+
+// Add moves the clock forward and fires the timers which are due
+func (c *MockClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.until.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = timers
+}
+
+func (c *MockClock) stop(t *mockTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+type mockTimer struct {
+	c     *MockClock
+	ch    chan time.Time
+	until time.Time
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *mockTimer) Stop() bool {
+	return t.c.stop(t)
+}
+
+// NewMockClock returns a MockClock set to the given time
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
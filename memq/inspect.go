@@ -0,0 +1,143 @@
+package memq
+
+import (
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal/logger"
+)
+
+//
+// Inspector of the queue
+//
+
+// Peek returns up to n waiting messages in delivery order, spilled messages come last.
+// In broadcast mode, the messages wait in the subscriptions, inspect them instead
+func (q *Queue) Peek(n int) ([]queue.Message, error) {
+	return q.List(0, n)
+}
+
+// List returns up to limit waiting messages in delivery order, skipping the first offset messages
+func (q *Queue) List(offset, limit int) ([]queue.Message, error) {
+	return q.list(q.buffer, q.spill, offset, limit)
+}
+
+// Delete removes the waiting message with the given id
+func (q *Queue) Delete(id string) error {
+	return q.delete(q.buffer, q.spill, id)
+}
+
+// Purge removes all waiting messages, delayed and in-flight messages are kept
+func (q *Queue) Purge() error {
+	return q.purge(q.buffer, q.spill)
+}
+
+//
+// Inspector of the subscription
+//
+
+// Peek returns up to n messages waiting in the subscription in delivery order
+func (s *Subscription) Peek(n int) ([]queue.Message, error) {
+	return s.List(0, n)
+}
+
+// List returns up to limit messages waiting in the subscription, skipping the first offset messages
+func (s *Subscription) List(offset, limit int) ([]queue.Message, error) {
+	return s.q.list(s.buffer, nil, offset, limit)
+}
+
+// Delete removes the message with the given id from the subscription
+func (s *Subscription) Delete(id string) error {
+	return s.q.delete(s.buffer, nil, id)
+}
+
+// Purge removes all messages waiting in the subscription
+func (s *Subscription) Purge() error {
+	return s.q.purge(s.buffer, nil)
+}
+
+func (q *Queue) list(b *buffer, sp *spill, offset, limit int) ([]queue.Message, error) {
+	messages := b.list()
+
+	if sp != nil {
+		spilled, err := sp.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range spilled {
+			messages = append(messages, q.restore(m))
+		}
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(messages) {
+		offset = len(messages)
+	}
+	messages = messages[offset:]
+	if limit >= 0 && limit < len(messages) {
+		messages = messages[:limit]
+	}
+
+	result := make([]queue.Message, len(messages))
+	for i, m := range messages {
+		result[i] = m.snapshot()
+	}
+
+	return result, nil
+}
+
+func (q *Queue) delete(b *buffer, sp *spill, id string) error {
+	defer q.watermark()
+
+	if m := b.remove(id); m != nil {
+		return q.ack(m)
+	}
+
+	if sp != nil {
+		ok, err := sp.remove(id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			q.refill()
+			if q.persistence != nil {
+				return q.persistence.acked(id)
+			}
+			return nil
+		}
+	}
+
+	return queue.ErrMessageNotFound
+}
+
+func (q *Queue) purge(b *buffer, sp *spill) error {
+	defer q.watermark()
+
+	var ids []string
+	if sp != nil {
+		// empty the spill first, otherwise its messages are moved to the buffer
+		spilled, err := sp.reset()
+		if err != nil {
+			return err
+		}
+		for _, m := range spilled {
+			ids = append(ids, m.ID)
+		}
+	}
+
+	for _, m := range b.clear() {
+		ids = append(ids, m.id)
+	}
+
+	if q.persistence == nil {
+		return nil
+	}
+
+	for _, id := range ids {
+		if err := q.persistence.acked(id); err != nil {
+			logger.Errorf("memq: purge message %s error %s", id, err)
+		}
+	}
+
+	return nil
+}
@@ -2,19 +2,92 @@ package memq
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ibllex/go-encoding"
 	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal"
+	"github.com/ibllex/go-queue/internal/logger"
+)
+
+var (
+	ErrQueueFull   = errors.New("memq: queue is full")
+	ErrRedelivered = errors.New("memq: message has been redelivered after visibility timeout")
+	ErrInspected   = errors.New("memq: inspected messages can not be acked or rejected")
+)
+
+// OverflowPolicy decides what happens when publishing to a full buffer
+type OverflowPolicy int
+
+const (
+	// Block the producer until there is room in the buffer
+	Block OverflowPolicy = iota
+	// BlockWithTimeout blocks the producer up to BlockTimeout,
+	// then returns ErrQueueFull
+	BlockWithTimeout
+	// Fail returns ErrQueueFull immediately
+	Fail
+	// DropNewest discards the published message
+	DropNewest
+	// DropOldest discards the earliest published message in the buffer
+	DropOldest
+	// SpillToDisk writes the overflowing messages to a file in SpillDir,
+	// they are moved back to the buffer in publishing order when there is room
+	SpillToDisk
 )
 
 type QueueOption struct {
 	// Maximum number of messages that can be stored in the queue,
-	// default is 1000
+	// default is 1000. Messages are delivered in order of priority,
+	// and in publishing order within the same priority
 	BufferSize int
 	// Synchronize messages
 	Sync bool
 	// Synchronize messages handler
 	SyncHandler queue.Handler
+	// Maximum number of delayed messages waiting in the scheduler,
+	// default is 0 (unlimited)
+	MaxDelayed int
+	// Clock of the delay scheduler, default is the system clock
+	Clock Clock
+	// PersistenceDir enables durability, publishes, acks, rejects and delayed messages
+	// are appended to a write-ahead log in the directory, pending and delayed messages
+	// are recovered by NewQueue. Default is empty (disabled)
+	PersistenceDir string
+	// The log is compacted into a snapshot after every SnapshotEvery records,
+	// default is 10000
+	SnapshotEvery int
+	// Codec is using for marshal and unmarshal persisted and spilled messages,
+	// default is gob codec with s2 compression
+	Codec encoding.Codec
+	// Encode all messages with the Codec at publish time, so that consumers
+	// get a copy of the message like the other backends, instead of the published value
+	Encode bool
+	// Messages delivered to consumers and neither acked nor rejected within
+	// VisibilityTimeout are delivered again. Default is 0 (never redeliver)
+	VisibilityTimeout time.Duration
+	// What to do when the buffer is full, default is Block
+	Overflow OverflowPolicy
+	// Used by BlockWithTimeout, default is 1 second
+	BlockTimeout time.Duration
+	// Broadcast every message to all consumers, each consumer has its own
+	// subscription buffer of BufferSize, which follows the Overflow policy.
+	// It can not be used with Sync, persistence or SpillToDisk
+	Broadcast bool
+	// Used by SpillToDisk, the spill file is emptied by NewQueue,
+	// so spilled messages are only recovered if persistence is enabled
+	SpillDir string
+	// OnHighWatermark is called once the size of the queue reaches HighWatermark,
+	// OnLowWatermark is called once it falls back to LowWatermark,
+	// so that producers can throttle themselves. Default is 0 (disabled)
+	HighWatermark   int
+	LowWatermark    int
+	OnHighWatermark func(size int)
+	OnLowWatermark  func(size int)
 }
 
 type Option func(opt *QueueOption) *QueueOption
@@ -34,11 +107,127 @@ func WithBufferSize(bufferSize int) Option {
 	}
 }
 
+func WithMaxDelayed(maxDelayed int) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.MaxDelayed = maxDelayed
+		return opt
+	}
+}
+
+func WithClock(clock Clock) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.Clock = clock
+		return opt
+	}
+}
+
+// WithPersistence keeps the messages of the queue in the directory,
+// so that they survive restarts, call Queue.Close before exiting
+func WithPersistence(dir string) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.PersistenceDir = dir
+		return opt
+	}
+}
+
+// WithCodec encodes all messages with the codec at publish time,
+// if codec is nil, the default codec is used
+func WithCodec(codec encoding.Codec) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.Encode = true
+		if codec != nil {
+			opt.Codec = codec
+		}
+		return opt
+	}
+}
+
+func WithVisibilityTimeout(timeout time.Duration) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.VisibilityTimeout = timeout
+		return opt
+	}
+}
+
+// WithBroadcast delivers every message to all consumers,
+// policy is the default overflow policy of the subscriptions
+func WithBroadcast(policy OverflowPolicy) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.Broadcast = true
+		opt.Overflow = policy
+		return opt
+	}
+}
+
+func WithOverflow(policy OverflowPolicy) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.Overflow = policy
+		return opt
+	}
+}
+
+func WithBlockTimeout(timeout time.Duration) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.Overflow = BlockWithTimeout
+		opt.BlockTimeout = timeout
+		return opt
+	}
+}
+
+func WithSpill(dir string) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.Overflow = SpillToDisk
+		opt.SpillDir = dir
+		return opt
+	}
+}
+
+func WithWatermarks(high, low int, onHigh, onLow func(size int)) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.HighWatermark = high
+		opt.LowWatermark = low
+		opt.OnHighWatermark = onHigh
+		opt.OnLowWatermark = onLow
+		return opt
+	}
+}
+
+func WithSnapshotEvery(records int) Option {
+	return func(opt *QueueOption) *QueueOption {
+		opt.SnapshotEvery = records
+		return opt
+	}
+}
+
 type Queue struct {
-	name   string
-	buffer chan queue.Message
+	name      string
+	opt       *QueueOption
+	buffer    *buffer
+	scheduler *scheduler
+
+	// messages delivered to consumers, which are neither acked nor rejected,
+	// visibility schedules the redelivery of them
+	inflightMu sync.Mutex
+	inflight   map[string]*Message
+	visibility *scheduler
+
+	persistence *persistence
+	spill       *spill
+	refillMu    sync.Mutex
+
+	dropped uint64
+	// whether the size is above the low watermark after reaching the high watermark
+	wmMu   sync.Mutex
+	wmHigh bool
 
 	syncConsumer *queue.Consumer
+
+	// subscriptions of the broadcast mode
+	subsMu sync.RWMutex
+	subs   map[string]*Subscription
+
+	// pending calls waiting for reply
+	calls sync.Map
 }
 
 func NewQueue(name string, opts ...Option) (*Queue, error) {
@@ -56,9 +245,60 @@ func NewQueue(name string, opts ...Option) (*Queue, error) {
 		opt.BufferSize = 1000
 	}
 
+	if opt.SnapshotEvery <= 0 {
+		opt.SnapshotEvery = 10000
+	}
+
+	if opt.BlockTimeout <= 0 {
+		opt.BlockTimeout = time.Second
+	}
+
+	if opt.Clock == nil {
+		opt.Clock = realClock{}
+	}
+
+	if opt.Codec == nil {
+		opt.Codec = encoding.NewGobCodec(
+			encoding.NewS2Compressor(),
+		)
+	}
+
+	if opt.Broadcast && (opt.Sync || opt.PersistenceDir != "" || opt.Overflow == SpillToDisk) {
+		return nil, errors.New("memq: broadcast can not be used with sync, persistence or spill")
+	}
+
 	q := &Queue{
-		name:   name,
-		buffer: make(chan queue.Message, opt.BufferSize),
+		name:     name,
+		opt:      opt,
+		inflight: make(map[string]*Message),
+		subs:     make(map[string]*Subscription),
+	}
+	q.scheduler = newScheduler(opt.Clock, opt.MaxDelayed, q.fire)
+	q.visibility = newScheduler(opt.Clock, 0, q.expire)
+
+	bufferSize := opt.BufferSize
+	if opt.PersistenceDir != "" {
+		q.persistence, err = openPersistence(opt.PersistenceDir, name, opt.SnapshotEvery)
+		if err != nil {
+			return nil, fmt.Errorf("memq: open persistence error: %s", err)
+		}
+
+		// recovered messages must not block NewQueue
+		if len(q.persistence.pending) > bufferSize {
+			bufferSize = len(q.persistence.pending)
+		}
+	}
+	q.buffer = newBuffer(bufferSize)
+
+	if opt.Overflow == SpillToDisk {
+		if opt.SpillDir == "" {
+			return nil, errors.New("memq: spill directory is required")
+		}
+
+		q.spill, err = openSpill(opt.SpillDir, name)
+		if err != nil {
+			return nil, fmt.Errorf("memq: open spill error: %s", err)
+		}
 	}
 
 	if opt.Sync {
@@ -71,58 +311,559 @@ func NewQueue(name string, opts ...Option) (*Queue, error) {
 		q.syncConsumer = syncConsumer
 	}
 
+	if q.persistence != nil {
+		q.recover()
+	}
+
 	return q, nil
 }
 
+// recover delivers the pending messages and schedules the delayed messages
+// loaded from the persistence
+func (q *Queue) recover() {
+	for _, m := range q.persistence.pendingMessages() {
+		logger.LogIfError(q.redeliver(q.restore(m)))
+	}
+
+	for id, s := range q.persistence.pendingSchedules() {
+		messages := make([]*Message, len(s.messages))
+		for i, m := range s.messages {
+			messages[i] = q.restore(m)
+		}
+		logger.LogIfError(q.scheduler.add(id, s.due, messages))
+	}
+}
+
+// Close the persistence of the queue, a final snapshot is written
+func (q *Queue) Close() error {
+	if q.persistence == nil {
+		return nil
+	}
+
+	return q.persistence.close()
+}
+
+// Size returns the number of messages waiting for delivery, including spilled messages,
+// in broadcast mode, it is the sum of messages waiting in all subscriptions
 func (q *Queue) Size() int {
-	return len(q.buffer)
+	size := q.buffer.len()
+	if q.spill != nil {
+		size += q.spill.len()
+	}
+
+	for _, sub := range q.subscriptions() {
+		size += sub.Size()
+	}
+
+	return size
+}
+
+// InFlight returns the number of messages delivered to consumers,
+// which are neither acked nor rejected
+func (q *Queue) InFlight() int {
+	q.inflightMu.Lock()
+	defer q.inflightMu.Unlock()
+
+	return len(q.inflight)
+}
+
+// Dropped returns the number of messages discarded by DropNewest or DropOldest
+func (q *Queue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Delayed returns the number of messages waiting to be published by Later or At
+func (q *Queue) Delayed() int {
+	return q.scheduler.len()
+}
+
+// NextDue returns the time when the next delayed messages are due
+func (q *Queue) NextDue() (time.Time, bool) {
+	return q.scheduler.next()
 }
 
 func (q *Queue) Name() string {
 	return q.name
 }
 
+// CarriesProperties implements queue.PropertiesPublisher
+func (q *Queue) CarriesProperties() bool {
+	return true
+}
+
 func (q *Queue) Daemon(ctx context.Context, handler queue.HandlerFunc) error {
+	return q.daemon(ctx, q.buffer, handler)
+}
+
+func (q *Queue) daemon(ctx context.Context, b *buffer, handler queue.HandlerFunc) error {
 
 	for {
-		select {
-		case <-ctx.Done():
+		msg := b.pop(ctx)
+		if msg == nil {
 			return nil
-		case msg := <-q.buffer:
-			handler(msg)
 		}
+
+		q.refill()
+		q.watermark()
+		q.track(msg)
+		handler(msg)
+	}
+
+}
+
+// Worker returns the queue itself, or a new subscription in broadcast mode,
+// which is closed when the consumer stops
+func (q *Queue) Worker(opt *queue.ConsumerOption) queue.Worker {
+	if q.opt.Broadcast {
+		s := q.Subscribe(q.opt.Overflow)
+		s.consumer = true
+		return s
 	}
 
+	return q
 }
 
+// Consumer creates a consumer of the queue,
+// in broadcast mode, every consumer has its own subscription
 func (q *Queue) Consumer(opt *queue.ConsumerOption) (*queue.Consumer, error) {
-	return queue.NewConsumer(q, opt)
+	return queue.NewConsumer(q.Worker(opt), opt)
+}
+
+func (q *Queue) Publish(messages ...interface{}) error {
+	for _, msg := range messages {
+		m, err := q.newMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		if err = q.publish(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newMessage creates the message to publish, which is encoded if required
+func (q *Queue) newMessage(v interface{}) (*Message, error) {
+	m := NewMessage(q, v)
+	if !q.opt.Encode {
+		return m, nil
+	}
+
+	body, err := q.opt.Codec.Marshal(m.data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := m.data.([]byte); ok {
+		// codecs return raw bytes as they are
+		copied := make([]byte, len(body))
+		copy(copied, body)
+		body = copied
+	}
+
+	m.data, m.body, m.encoded = nil, body, true
+	return m, nil
 }
 
-func (q *Queue) Publish(messages ...interface{}) (err error) {
+func (q *Queue) publish(m *Message) error {
+	if q.persistence != nil {
+		stored, err := q.store(m)
+		if err != nil {
+			return err
+		}
+
+		if err = q.persistence.published(stored); err != nil {
+			return err
+		}
+	}
+
+	return q.deliver(m)
+}
+
+func (q *Queue) deliver(m *Message) (err error) {
 	if q.syncConsumer != nil {
-		for _, msg := range messages {
-			err = q.syncConsumer.Process(NewMessage(q, msg))
-			if err != nil {
-				return err
+		return q.syncConsumer.Process(m)
+	}
+
+	defer q.watermark()
+
+	if q.opt.Broadcast {
+		return q.broadcast(m)
+	}
+
+	// keep the publishing order while there are spilled messages
+	if q.spill != nil && q.spill.len() > 0 {
+		return q.spillOver(m)
+	}
+
+	if q.opt.Overflow == SpillToDisk {
+		if !q.buffer.tryPush(m) {
+			err = q.spillOver(m)
+		}
+	} else {
+		err = q.push(q.buffer, q.opt.Overflow, m)
+	}
+
+	if err == ErrQueueFull && q.persistence != nil {
+		// the message has been logged, but it will never be delivered
+		logger.LogIfError(q.persistence.acked(m.id))
+	}
+
+	return
+}
+
+// push adds the message to the buffer, following the policy when it is full
+func (q *Queue) push(b *buffer, policy OverflowPolicy, m *Message) (err error) {
+	switch policy {
+	case BlockWithTimeout:
+		if !b.pushTimeout(m, q.opt.BlockTimeout) {
+			err = ErrQueueFull
+		}
+	case Fail:
+		if !b.tryPush(m) {
+			err = ErrQueueFull
+		}
+	case DropNewest:
+		if !b.tryPush(m) {
+			err = q.drop(m)
+		}
+	case DropOldest:
+		if !b.tryPush(m) {
+			if oldest := b.replaceOldest(m); oldest != nil {
+				err = q.drop(oldest)
+			} else {
+				b.push(m)
 			}
 		}
+	default:
+		b.push(m)
+	}
+
+	return
+}
+
+func (q *Queue) drop(m *Message) error {
+	atomic.AddUint64(&q.dropped, 1)
+	return q.ack(m)
+}
+
+func (q *Queue) spillOver(m *Message) error {
+	stored, err := q.store(m)
+	if err != nil {
+		return err
+	}
 
+	return q.spill.push(stored)
+}
+
+// refill moves spilled messages back to the buffer while there is room
+func (q *Queue) refill() {
+	if q.spill == nil {
 		return
 	}
 
-	for _, msg := range messages {
-		q.buffer <- NewMessage(q, msg)
+	q.refillMu.Lock()
+	defer q.refillMu.Unlock()
+
+	for {
+		stored, err := q.spill.peek()
+		if err != nil {
+			logger.Errorf("memq: read spilled message error %s", err)
+			return
+		}
+
+		if stored == nil || !q.buffer.tryPush(q.restore(stored)) {
+			return
+		}
+
+		logger.LogIfError(q.spill.pop())
 	}
+}
 
-	return
+// watermark calls the watermark callbacks when the size crosses the watermarks
+func (q *Queue) watermark() {
+	if q.opt.HighWatermark <= 0 {
+		return
+	}
+
+	size := q.Size()
+	var callback func(int)
+
+	q.wmMu.Lock()
+	if !q.wmHigh && size >= q.opt.HighWatermark {
+		q.wmHigh = true
+		callback = q.opt.OnHighWatermark
+	} else if q.wmHigh && size <= q.opt.LowWatermark {
+		q.wmHigh = false
+		callback = q.opt.OnLowWatermark
+	}
+	q.wmMu.Unlock()
+
+	if callback != nil {
+		callback(size)
+	}
+}
+
+// track the message delivered to a consumer
+func (q *Queue) track(m *Message) {
+	q.inflightMu.Lock()
+	defer q.inflightMu.Unlock()
+
+	m.deliveries++
+	m.delivered = true
+	q.inflight[m.id] = m
+
+	if q.opt.VisibilityTimeout > 0 {
+		due := q.opt.Clock.Now().Add(q.opt.VisibilityTimeout)
+		logger.LogIfError(q.visibility.add(m.id, due, []*Message{m}))
+	}
+}
+
+// settle stops tracking the delivered message when it is acked or rejected
+func (q *Queue) settle(m *Message) error {
+	if !m.delivered {
+		return nil
+	}
+
+	q.inflightMu.Lock()
+	defer q.inflightMu.Unlock()
+
+	if q.inflight[m.id] != m {
+		return ErrRedelivered
+	}
+
+	delete(q.inflight, m.id)
+	if q.opt.VisibilityTimeout > 0 {
+		q.visibility.remove(m.id)
+	}
+
+	return nil
+}
+
+// expire redelivers the message which is not settled within the visibility timeout
+func (q *Queue) expire(id string, messages []*Message) error {
+	q.inflightMu.Lock()
+	m := messages[0]
+	if q.inflight[id] != m {
+		q.inflightMu.Unlock()
+		return nil
+	}
+	delete(q.inflight, id)
+	q.inflightMu.Unlock()
+
+	return q.redeliver(m.redelivery())
+}
+
+func (q *Queue) ack(m *Message) error {
+	if q.persistence != nil {
+		return q.persistence.acked(m.id)
+	}
+
+	return nil
+}
+
+func (q *Queue) requeue(m *Message) error {
+	if q.persistence != nil {
+		if err := q.persistence.rejected(m.id); err != nil {
+			return err
+		}
+	}
+
+	return q.redeliver(m.redelivery())
+}
+
+// redeliver puts back a message which has already been accepted by the queue, e.g. a rejected,
+// expired or recovered one. The overflow policy does not apply, so it is never discarded
+func (q *Queue) redeliver(m *Message) error {
+	if q.syncConsumer != nil {
+		return q.syncConsumer.Process(m)
+	}
+
+	defer q.watermark()
+
+	// rejected messages go back to their subscription, unless it is closed
+	if m.sub != nil {
+		if m.sub.subscribed() {
+			m.sub.buffer.force(m)
+		}
+		return nil
+	}
+
+	if q.spill == nil {
+		q.buffer.force(m)
+		return nil
+	}
+
+	if !q.buffer.tryPush(m) {
+		return q.spillOver(m)
+	}
+
+	return nil
+}
+
+// fire publishes the delayed messages when they are due
+func (q *Queue) fire(id string, messages []*Message) error {
+	for i, m := range messages {
+		if err := q.publish(m); err != nil {
+			if q.persistence != nil && i > 0 {
+				// only the messages which are not published are replayed after a restart
+				logger.LogIfError(q.fired(id, messages[i:]))
+			}
+			return err
+		}
+	}
+
+	if q.persistence != nil {
+		return q.persistence.unscheduled(id)
+	}
+
+	return nil
+}
+
+// fired replaces the persisted schedule with its remaining messages
+func (q *Queue) fired(id string, remaining []*Message) error {
+	stored := make([]*storedMessage, len(remaining))
+	for i, m := range remaining {
+		s, err := q.store(m)
+		if err != nil {
+			return err
+		}
+		stored[i] = s
+	}
+
+	return q.persistence.fired(id, stored)
+}
+
+// store encodes the message for persistence
+func (q *Queue) store(m *Message) (*storedMessage, error) {
+	if !m.encoded && m.body == nil {
+		body, err := q.opt.Codec.Marshal(m.data)
+		if err != nil {
+			return nil, err
+		}
+		m.body = body
+	}
+
+	return &storedMessage{ID: m.id, Body: m.body, Props: m.props}, nil
+}
+
+// restore creates the message loaded from persistence
+func (q *Queue) restore(m *storedMessage) *Message {
+	return &Message{q: q, id: m.ID, body: m.Body, encoded: true, props: m.Props}
 }
 
 func (q *Queue) Later(delay time.Duration, messages ...interface{}) error {
+	_, err := q.At(q.scheduler.clock.Now().Add(delay), messages...)
+	return err
+}
 
-	time.AfterFunc(delay, func() {
-		q.Publish(messages...)
-	})
+func (q *Queue) At(t time.Time, messages ...interface{}) (string, error) {
+
+	id := internal.RandomString(16)
+	delayed := make([]*Message, len(messages))
+	for i, msg := range messages {
+		m, err := q.newMessage(msg)
+		if err != nil {
+			return "", err
+		}
+		delayed[i] = m
+	}
+
+	if q.persistence != nil {
+		stored := make([]*storedMessage, len(delayed))
+		for i, m := range delayed {
+			var err error
+			if stored[i], err = q.store(m); err != nil {
+				return "", err
+			}
+		}
+
+		if err := q.persistence.scheduled(id, t, stored); err != nil {
+			return "", err
+		}
+	}
+
+	if err := q.scheduler.add(id, t, delayed); err != nil {
+		if q.persistence != nil {
+			logger.LogIfError(q.persistence.unscheduled(id))
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (q *Queue) Cancel(id string) error {
+	if err := q.scheduler.remove(id); err != nil {
+		return err
+	}
+
+	if q.persistence != nil {
+		return q.persistence.unscheduled(id)
+	}
+
+	return nil
+}
+
+func (q *Queue) Reschedule(id string, t time.Time) error {
+	if err := q.scheduler.reschedule(id, t); err != nil {
+		return err
+	}
+
+	if q.persistence != nil {
+		return q.persistence.rescheduled(id, t)
+	}
 
 	return nil
 }
+
+func (q *Queue) Call(ctx context.Context, req interface{}, resp interface{}) error {
+
+	body, props := queue.Unwrap(req)
+	props.CorrelationID = internal.RandomString(32)
+	props.ReplyTo = q.name
+
+	reply := make(chan *Message, 1)
+	q.calls.Store(props.CorrelationID, reply)
+	defer q.calls.Delete(props.CorrelationID)
+
+	err := q.Publish(&queue.Envelope{Properties: props, Body: body})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case m := <-reply:
+		if resp == nil {
+			return nil
+		}
+		return m.Unmarshal(resp)
+	}
+}
+
+func (q *Queue) reply(id string, v interface{}) error {
+
+	c, ok := q.calls.Load(id)
+	if !ok {
+		return fmt.Errorf("memq: no pending call for %s", id)
+	}
+
+	m, err := q.newMessage(&queue.Envelope{
+		Properties: queue.Properties{CorrelationID: id},
+		Body:       v,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.(chan *Message) <- m:
+		return nil
+	default:
+		return fmt.Errorf("memq: call %s has already been replied", id)
+	}
+}
@@ -1,14 +1,32 @@
 package memq_test
 
 import (
+	"context"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/ibllex/go-encoding"
+	"github.com/ibllex/go-queue"
 	"github.com/ibllex/go-queue/memq"
+	"github.com/ibllex/go-queue/queuetest"
 	"github.com/stretchr/testify/assert"
 )
 
+// assertSize waits for the scheduler to publish the due messages
+func assertSize(t *testing.T, q *memq.Queue, size int) {
+	assert.Eventually(t, func() bool {
+		return q.Size() == size
+	}, time.Second, time.Millisecond)
+}
+
+func TestConformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T) queue.Queue {
+		q, _ := memq.NewQueue(t.Name())
+		return q
+	})
+}
+
 func TestQueue(t *testing.T) {
 
 	t.Run("publish", func(t *testing.T) {
@@ -20,13 +38,148 @@ func TestQueue(t *testing.T) {
 	})
 
 	t.Run("later", func(t *testing.T) {
-		q, _ := memq.NewQueue("default")
+		clock := memq.NewMockClock(time.Now())
+		q, _ := memq.NewQueue("default", memq.WithClock(clock))
 		assert.Equal(t, 0, q.Size())
 
 		q.Later(100*time.Millisecond, "hello")
 		assert.Equal(t, 0, q.Size())
+		assert.Equal(t, 1, q.Delayed())
+
+		clock.Add(100 * time.Millisecond)
+		assertSize(t, q, 1)
+		assert.Equal(t, 0, q.Delayed())
+	})
+
+	t.Run("mock clock", func(t *testing.T) {
+		clock := memq.NewMockClock(time.Now())
+		due := clock.Now().Add(100 * time.Millisecond)
+
+		// the deadline does not move with the clock, even if it is moved before the timer is created
+		clock.Add(50 * time.Millisecond)
+		timer := clock.NewTimerAt(due)
+		clock.Add(50 * time.Millisecond)
+
+		select {
+		case <-timer.C():
+		default:
+			t.Fatal("timer is not fired when due")
+		}
+
+		select {
+		case <-clock.NewTimerAt(due).C():
+		default:
+			t.Fatal("timer of a past time is not fired")
+		}
+	})
+
+	t.Run("at", func(t *testing.T) {
+		clock := memq.NewMockClock(time.Now())
+		q, _ := memq.NewQueue("default", memq.WithClock(clock))
+
+		due := clock.Now().Add(100 * time.Millisecond)
+		id, err := q.At(due, "hello")
+		assert.Nil(t, err)
+		assert.NotEmpty(t, id)
+		assert.Equal(t, 0, q.Size())
+
+		next, ok := q.NextDue()
+		assert.True(t, ok)
+		assert.Equal(t, due, next)
+
+		clock.Add(100 * time.Millisecond)
+		assertSize(t, q, 1)
+		assert.Equal(t, queue.ErrScheduleNotFound, q.Cancel(id))
+
+		_, ok = q.NextDue()
+		assert.False(t, ok)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		clock := memq.NewMockClock(time.Now())
+		q, _ := memq.NewQueue("default", memq.WithClock(clock))
+
+		id, _ := q.At(clock.Now().Add(100*time.Millisecond), "hello")
+		q.Later(200*time.Millisecond, "world")
+		assert.Nil(t, q.Cancel(id))
+		assert.Equal(t, queue.ErrScheduleNotFound, q.Cancel(id))
+		assert.Equal(t, queue.ErrScheduleNotFound, q.Cancel("unknown"))
+		assert.Equal(t, 1, q.Delayed())
 
-		time.Sleep(200 * time.Millisecond)
+		clock.Add(200 * time.Millisecond)
+		assertSize(t, q, 1)
+		assert.Equal(t, 0, q.Delayed())
+	})
+
+	t.Run("reschedule", func(t *testing.T) {
+		clock := memq.NewMockClock(time.Now())
+		q, _ := memq.NewQueue("default", memq.WithClock(clock))
+
+		id, _ := q.At(clock.Now().Add(100*time.Millisecond), "hello")
+		q.Later(200*time.Millisecond, "world")
+		assert.Nil(t, q.Reschedule(id, clock.Now().Add(300*time.Millisecond)))
+
+		clock.Add(200 * time.Millisecond)
+		assertSize(t, q, 1)
+		assert.Equal(t, 1, q.Delayed())
+
+		clock.Add(100 * time.Millisecond)
+		assertSize(t, q, 2)
+		assert.Equal(t, queue.ErrScheduleNotFound, q.Reschedule(id, clock.Now()))
+	})
+
+	t.Run("max delayed", func(t *testing.T) {
+		clock := memq.NewMockClock(time.Now())
+		q, _ := memq.NewQueue("default", memq.WithClock(clock), memq.WithMaxDelayed(2))
+
+		assert.Nil(t, q.Later(time.Second, 1, 2))
+		assert.Equal(t, memq.ErrTooManyDelayed, q.Later(time.Second, 3))
+		assert.Equal(t, 2, q.Delayed())
+
+		clock.Add(time.Second)
+		assertSize(t, q, 2)
+		assert.Nil(t, q.Later(time.Second, 3))
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		q, _ := memq.NewQueue("default")
+		for i, p := range []uint8{0, 5, 1, 5, 0, 9} {
+			q.Publish(&queue.Envelope{Properties: queue.Properties{Priority: p}, Body: i})
+		}
+
+		var order []int
+		ctx, cancel := context.WithCancel(context.Background())
+		q.Daemon(ctx, func(m queue.Message) {
+			var v int
+			assert.Nil(t, m.Unmarshal(&v))
+			order = append(order, v)
+			if len(order) == 6 {
+				cancel()
+			}
+		})
+
+		assert.Equal(t, []int{5, 1, 3, 2, 0, 4}, order)
+	})
+
+	t.Run("block when full", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(1))
+		q.Publish(0)
+
+		published := make(chan bool)
+		go func() {
+			q.Publish(1)
+			published <- true
+		}()
+
+		select {
+		case <-published:
+			t.Fatal("publish should block when the buffer is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go q.Daemon(ctx, func(m queue.Message) { cancel() })
+		<-published
 		assert.Equal(t, 1, q.Size())
 	})
 }
@@ -107,3 +260,428 @@ func TestMessageUnmarshal(t *testing.T) {
 		}
 	})
 }
+
+func TestOverflow(t *testing.T) {
+
+	t.Run("block with timeout", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(1), memq.WithBlockTimeout(10*time.Millisecond))
+		assert.Nil(t, q.Publish(1))
+		assert.Equal(t, memq.ErrQueueFull, q.Publish(2))
+		assert.Equal(t, 1, q.Size())
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(2), memq.WithOverflow(memq.Fail))
+		assert.Nil(t, q.Publish(1, 2))
+		assert.Equal(t, memq.ErrQueueFull, q.Publish(3))
+		assert.Equal(t, 2, q.Size())
+	})
+
+	t.Run("rejected messages bypass the policy", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(1), memq.WithOverflow(memq.Fail))
+		assert.Nil(t, q.Publish("a"))
+		m := take(q, 1)[0]
+
+		assert.Nil(t, q.Publish("b"))
+		assert.Nil(t, m.Reject())
+		assert.Equal(t, 2, q.Size())
+		assert.ElementsMatch(t, []string{"a", "b"}, values(t, take(q, 2)))
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(2), memq.WithOverflow(memq.DropNewest))
+		assert.Nil(t, q.Publish("a", "b", "c"))
+		assert.Equal(t, uint64(1), q.Dropped())
+		assert.Equal(t, []string{"a", "b"}, values(t, take(q, 2)))
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(2), memq.WithOverflow(memq.DropOldest))
+		assert.Nil(t, q.Publish("a", "b", "c", "d"))
+		assert.Equal(t, uint64(2), q.Dropped())
+		assert.Equal(t, []string{"c", "d"}, values(t, take(q, 2)))
+
+		// a rejected message holds no slot, the one replacing it neither
+		q, _ = memq.NewQueue("default", memq.WithBufferSize(1), memq.WithOverflow(memq.DropOldest))
+		assert.Nil(t, q.Publish("a"))
+		assert.Nil(t, take(q, 1)[0].Reject())
+		assert.Nil(t, q.Publish("b", "c"))
+		assert.Equal(t, uint64(1), q.Dropped())
+		assert.Equal(t, []string{"b", "c"}, values(t, take(q, 2)))
+
+		assert.Nil(t, q.Publish("d", "e"))
+		assert.Equal(t, uint64(2), q.Dropped())
+		assert.Equal(t, []string{"e"}, values(t, take(q, 1)))
+	})
+
+	t.Run("spill to disk", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(2), memq.WithSpill(tempDir(t)))
+		assert.Nil(t, q.Publish("a", "b", "c", "d", "e"))
+		assert.Equal(t, 5, q.Size())
+
+		assert.Equal(t, []string{"a", "b", "c"}, values(t, take(q, 3)))
+		assert.Nil(t, q.Publish("f"))
+		assert.Equal(t, []string{"d", "e", "f"}, values(t, take(q, 3)))
+		assert.Equal(t, 0, q.Size())
+	})
+
+	t.Run("spill without directory", func(t *testing.T) {
+		_, err := memq.NewQueue("default", memq.WithOverflow(memq.SpillToDisk))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("watermarks", func(t *testing.T) {
+		var events []string
+		q, _ := memq.NewQueue("default", memq.WithWatermarks(3, 1,
+			func(size int) { events = append(events, "high") },
+			func(size int) { events = append(events, "low") },
+		))
+
+		assert.Nil(t, q.Publish(1, 2))
+		assert.Empty(t, events)
+		assert.Nil(t, q.Publish(3, 4))
+		assert.Equal(t, []string{"high"}, events)
+
+		take(q, 2)
+		assert.Equal(t, []string{"high"}, events)
+		take(q, 1)
+		assert.Equal(t, []string{"high", "low"}, events)
+	})
+}
+
+type Secret struct {
+	Data   string
+	hidden string
+}
+
+func TestCodec(t *testing.T) {
+
+	t.Run("copy semantics", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithCodec(encoding.NewJsonCodec(nil)))
+
+		data := &Secret{Data: "data", hidden: "hidden"}
+		assert.Nil(t, q.Publish(data))
+
+		m := take(q, 1)[0]
+		assert.JSONEq(t, `{"Data":"data"}`, string(m.Body()))
+
+		var target *Secret
+		assert.Nil(t, m.Unmarshal(&target))
+		assert.Equal(t, "data", target.Data)
+		assert.Empty(t, target.hidden)
+
+		target.Data = "changed"
+		assert.Equal(t, "data", data.Data)
+	})
+
+	t.Run("raw bytes", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithCodec(nil))
+
+		data := []byte("data")
+		assert.Nil(t, q.Publish(data))
+		data[0] = 'D'
+
+		assert.Equal(t, "data", string(take(q, 1)[0].Body()))
+	})
+
+	t.Run("empty payload", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithCodec(encoding.NewJsonCodec(nil)))
+		assert.Nil(t, q.Publish([]byte{}))
+
+		messages, err := q.List(0, -1)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 1)
+
+		var b []byte
+		assert.Nil(t, messages[0].Unmarshal(&b))
+		assert.Empty(t, b)
+
+		m := take(q, 1)[0]
+		assert.Equal(t, []byte{}, m.Body())
+	})
+
+	t.Run("not encodable", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithCodec(encoding.NewJsonCodec(nil)))
+		assert.NotNil(t, q.Publish(func() {}))
+		assert.Equal(t, 0, q.Size())
+	})
+
+	t.Run("without codec", func(t *testing.T) {
+		q, _ := memq.NewQueue("default")
+
+		data := &Secret{Data: "data"}
+		assert.Nil(t, q.Publish(data))
+
+		m := take(q, 1)[0]
+		assert.Nil(t, m.Body())
+
+		var target *Secret
+		assert.Nil(t, m.Unmarshal(&target))
+		assert.True(t, data == target)
+	})
+}
+
+func TestInFlight(t *testing.T) {
+
+	t.Run("settle", func(t *testing.T) {
+		q, _ := memq.NewQueue("default")
+		q.Publish(1, 2)
+
+		messages := take(q, 2)
+		assert.Equal(t, 0, q.Size())
+		assert.Equal(t, 2, q.InFlight())
+
+		assert.Nil(t, messages[0].Ack())
+		assert.Nil(t, messages[0].Ack())
+		assert.Equal(t, 1, q.InFlight())
+
+		assert.Nil(t, messages[1].Reject())
+		assert.Equal(t, 0, q.InFlight())
+		assert.Equal(t, 1, q.Size())
+
+		m := take(q, 1)[0].(*memq.Message)
+		assert.Equal(t, 2, m.DeliveryCount())
+	})
+
+	t.Run("visibility timeout", func(t *testing.T) {
+		clock := memq.NewMockClock(time.Now())
+		q, _ := memq.NewQueue("default", memq.WithClock(clock), memq.WithVisibilityTimeout(time.Minute))
+		q.Publish(1, 2)
+
+		messages := take(q, 2)
+		assert.Equal(t, 1, messages[0].(*memq.Message).DeliveryCount())
+		assert.Nil(t, messages[1].Ack())
+
+		clock.Add(time.Minute)
+		assertSize(t, q, 1)
+		assert.Equal(t, 0, q.InFlight())
+
+		redelivered := take(q, 1)[0].(*memq.Message)
+		assert.Equal(t, 2, redelivered.DeliveryCount())
+		assert.Equal(t, 1, q.InFlight())
+
+		// the expired delivery can not be settled anymore
+		assert.Equal(t, memq.ErrRedelivered, messages[0].Ack())
+		assert.Equal(t, memq.ErrRedelivered, messages[0].Reject())
+
+		assert.Nil(t, redelivered.Ack())
+		assert.Equal(t, 0, q.InFlight())
+
+		clock.Add(time.Minute)
+		assert.Equal(t, 0, q.Size())
+	})
+}
+
+func TestBroadcast(t *testing.T) {
+
+	t.Run("every consumer sees every message", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBroadcast(memq.Block))
+
+		received := make(chan string, 4)
+		consume := func(name string) {
+			c, err := q.Consumer(&queue.ConsumerOption{
+				Handler: queue.H(func(m queue.Message) {
+					var v string
+					assert.Nil(t, m.Unmarshal(&v))
+					m.Ack()
+					received <- name + ":" + v
+				}),
+			})
+			assert.Nil(t, err)
+			assert.Nil(t, c.Start(context.Background()))
+		}
+
+		consume("a")
+		consume("b")
+		assert.Nil(t, q.Publish("1", "2"))
+
+		var got []string
+		for i := 0; i < 4; i++ {
+			got = append(got, <-received)
+		}
+		assert.ElementsMatch(t, []string{"a:1", "a:2", "b:1", "b:2"}, got)
+	})
+
+	t.Run("subscriptions", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBroadcast(memq.Block), memq.WithBufferSize(2))
+
+		// messages published without subscriptions are discarded
+		assert.Nil(t, q.Publish(0))
+		assert.Equal(t, 0, q.Size())
+
+		newest := q.Subscribe(memq.DropOldest)
+		oldest := q.Subscribe(memq.DropNewest)
+		strict := q.Subscribe(memq.Fail)
+
+		assert.Nil(t, q.Publish(1, 2))
+		assert.Equal(t, memq.ErrQueueFull, q.Publish(3))
+		assert.Equal(t, 6, q.Size())
+		assert.Equal(t, uint64(2), q.Dropped())
+
+		taken := func(s *memq.Subscription) []int {
+			var values []int
+			ctx, cancel := context.WithCancel(context.Background())
+			s.Daemon(ctx, func(m queue.Message) {
+				var v int
+				assert.Nil(t, m.Unmarshal(&v))
+				values = append(values, v)
+				if len(values) == 2 {
+					cancel()
+				}
+			})
+			return values
+		}
+
+		assert.Equal(t, []int{2, 3}, taken(newest))
+		assert.Equal(t, []int{1, 2}, taken(oldest))
+		assert.Equal(t, []int{1, 2}, taken(strict))
+
+		strict.Close()
+		assert.Nil(t, q.Publish(4))
+		assert.Equal(t, 2, q.Size())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBroadcast(memq.Block))
+		a := q.Subscribe(memq.Block)
+		b := q.Subscribe(memq.Block)
+		assert.Nil(t, q.Publish(1))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		a.Daemon(ctx, func(m queue.Message) {
+			assert.Nil(t, m.Reject())
+			cancel()
+		})
+
+		assert.Equal(t, 1, a.Size())
+		assert.Equal(t, 1, b.Size())
+	})
+
+	t.Run("stopped consumers are unsubscribed", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBroadcast(memq.Block), memq.WithBufferSize(2))
+
+		stopped := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		w := q.Worker(nil)
+		go func() {
+			w.Daemon(ctx, func(m queue.Message) { m.Ack() })
+			close(stopped)
+		}()
+
+		cancel()
+		<-stopped
+
+		// publishing would block on the buffer of the stopped consumer
+		published := make(chan error, 1)
+		go func() { published <- q.Publish(1, 2, 3, 4, 5) }()
+		select {
+		case err := <-published:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("publish is blocked by a stopped consumer")
+		}
+		assert.Equal(t, 0, q.Size())
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := memq.NewQueue("default", memq.WithBroadcast(memq.Block), memq.WithSync(nil))
+		assert.NotNil(t, err)
+	})
+}
+
+func TestInspector(t *testing.T) {
+
+	var _ queue.Inspector = &memq.Queue{}
+	var _ queue.Inspector = &memq.Subscription{}
+
+	t.Run("peek and list", func(t *testing.T) {
+		q, _ := memq.NewQueue("default")
+		q.Publish("a", "b", &queue.Envelope{Body: "c", Properties: queue.Properties{Priority: 1}})
+
+		messages, err := q.Peek(2)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"c", "a"}, values(t, messages))
+		assert.Equal(t, 3, q.Size())
+
+		messages, _ = q.List(1, 10)
+		assert.Equal(t, []string{"a", "b"}, values(t, messages))
+
+		assert.Equal(t, memq.ErrInspected, messages[0].Ack())
+		assert.Equal(t, memq.ErrInspected, messages[0].Reject())
+
+		messages, _ = q.List(5, 10)
+		assert.Empty(t, messages)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(2), memq.WithOverflow(memq.Fail))
+		q.Publish("a", "b")
+
+		messages, _ := q.Peek(1)
+		assert.Nil(t, q.Delete(queue.IDOf(messages[0])))
+		assert.Equal(t, queue.ErrMessageNotFound, q.Delete(queue.IDOf(messages[0])))
+
+		// the slot of the deleted message is released
+		assert.Nil(t, q.Publish("c"))
+		assert.Equal(t, []string{"b", "c"}, values(t, take(q, 2)))
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(2), memq.WithOverflow(memq.Fail))
+		q.Publish("a", "b")
+
+		assert.Nil(t, q.Purge())
+		assert.Equal(t, 0, q.Size())
+		assert.Nil(t, q.Publish("c", "d"))
+	})
+
+	t.Run("spilled messages", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBufferSize(1), memq.WithSpill(tempDir(t)))
+		q.Publish("a", "b", "c", "d")
+
+		messages, err := q.List(0, -1)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a", "b", "c", "d"}, values(t, messages))
+
+		assert.Nil(t, q.Delete(queue.IDOf(messages[2])))
+		assert.Equal(t, 3, q.Size())
+		assert.Equal(t, []string{"a", "b", "d"}, values(t, take(q, 3)))
+
+		q.Publish("e", "f", "g")
+		assert.Nil(t, q.Purge())
+		assert.Equal(t, 0, q.Size())
+
+		q.Publish("h", "i")
+		assert.Equal(t, []string{"h", "i"}, values(t, take(q, 2)))
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		dir := tempDir(t)
+		q, _ := memq.NewQueue("default", memq.WithPersistence(dir))
+		q.Publish("a", "b", "c")
+
+		messages, _ := q.Peek(1)
+		assert.Nil(t, q.Delete(queue.IDOf(messages[0])))
+		assert.Nil(t, q.Close())
+
+		q, _ = memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Equal(t, 2, q.Size())
+		assert.Nil(t, q.Purge())
+		assert.Nil(t, q.Close())
+
+		q, _ = memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Equal(t, 0, q.Size())
+	})
+
+	t.Run("subscription", func(t *testing.T) {
+		q, _ := memq.NewQueue("default", memq.WithBroadcast(memq.Block))
+		s1, s2 := q.Subscribe(memq.Block), q.Subscribe(memq.Block)
+		q.Publish("a", "b")
+
+		assert.Nil(t, s1.Purge())
+		assert.Equal(t, 0, s1.Size())
+
+		messages, _ := s2.Peek(10)
+		assert.Equal(t, []string{"a", "b"}, values(t, messages))
+	})
+}
@@ -6,22 +6,53 @@ import (
 	"reflect"
 
 	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal"
 )
 
 type Message struct {
-	q    queue.Queue
-	data interface{}
+	q *Queue
+	// other is the queue passed to NewMessage which is not a memq queue,
+	// rejected messages are published to it again
+	other queue.Queue
+	id    string
+	// subscription which the message is delivered to in broadcast mode
+	sub *Subscription
+	// data is the published value, body is the encoded value,
+	// encoded messages and messages recovered from persistence only have the body
+	data    interface{}
+	body    []byte
+	encoded bool
+	props   queue.Properties
+
+	// number of times the message has been delivered to consumers
+	deliveries int
+	delivered  bool
 
 	acked    bool
 	rejected bool
+	// inspected messages are snapshots returned by Peek and List
+	inspected bool
+}
+
+// ID returns the id of the message, which can be used to Delete it
+func (m *Message) ID() string {
+	return m.id
 }
 
 func (m *Message) Name() string {
+	if m.encoded {
+		return m.id
+	}
+
 	return fmt.Sprintf("%v", m.data)
 }
 
 func (m *Message) Unmarshal(value interface{}) error {
 
+	if m.encoded {
+		return m.q.opt.Codec.Unmarshal(m.body, value)
+	}
+
 	v := reflect.ValueOf(value)
 	if v.Type().Kind() != reflect.Ptr || !v.Elem().CanSet() {
 		return fmt.Errorf("memq.Message: can not set value %v", v)
@@ -47,24 +78,81 @@ func (m *Message) Unmarshal(value interface{}) error {
 }
 
 func (m *Message) Body() []byte {
-	return nil
+	return m.body
 }
 
 func (m *Message) Reject() error {
+	if m.inspected {
+		return ErrInspected
+	}
+
 	if m.acked {
 		return errors.New("you can not reject an acked message")
 	}
 
+	if m.q == nil {
+		m.rejected = true
+		if m.other == nil {
+			return nil
+		}
+		return m.other.Publish(m.data)
+	}
+
+	if err := m.q.settle(m); err != nil {
+		return err
+	}
+
 	m.rejected = true
-	return m.q.Publish(m.data)
+	return m.q.requeue(m)
 }
 
 func (m *Message) Ack() error {
+	if m.inspected {
+		return ErrInspected
+	}
+
 	if m.rejected {
 		return errors.New("you can not ack a rejected message")
 	}
+
+	if m.q == nil || m.acked {
+		m.acked = true
+		return nil
+	}
+
+	if err := m.q.settle(m); err != nil {
+		return err
+	}
+
 	m.acked = true
-	return nil
+	return m.q.ack(m)
+}
+
+// DeliveryCount returns the number of times the message has been delivered to consumers,
+// including this delivery
+func (m *Message) DeliveryCount() int {
+	return m.deliveries
+}
+
+// snapshot returns a copy of the message for inspection
+func (m *Message) snapshot() *Message {
+	c := m.redelivery()
+	c.inspected = true
+	return c
+}
+
+// redelivery returns a copy of the message to be delivered again
+func (m *Message) redelivery() *Message {
+	return &Message{
+		q:          m.q,
+		id:         m.id,
+		sub:        m.sub,
+		data:       m.data,
+		body:       m.body,
+		encoded:    m.encoded,
+		props:      m.props,
+		deliveries: m.deliveries,
+	}
 }
 
 func (m *Message) Status() queue.MessageStatus {
@@ -79,9 +167,36 @@ func (m *Message) Status() queue.MessageStatus {
 	return queue.Pending
 }
 
+func (m *Message) Properties() queue.Properties {
+	return m.props
+}
+
+func (m *Message) Reply(v interface{}) error {
+	if m.props.ReplyTo == "" {
+		return queue.ErrNoReplyTo
+	}
+
+	if m.q == nil {
+		return errors.New("message is not bound to a memq queue")
+	}
+
+	return m.q.reply(m.props.CorrelationID, v)
+}
+
 func NewMessage(q queue.Queue, v interface{}) *Message {
-	return &Message{
-		q:    q,
-		data: v,
+	data, props := queue.Unwrap(v)
+	m := &Message{
+		id:    internal.RandomString(16),
+		data:  data,
+		props: props,
 	}
+
+	// replies and the delivery state are only supported by memq queues
+	if mq, ok := q.(*Queue); ok {
+		m.q = mq
+	} else {
+		m.other = q
+	}
+
+	return m
 }
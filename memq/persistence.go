@@ -0,0 +1,354 @@
+package memq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ibllex/go-encoding"
+	"github.com/ibllex/go-queue"
+)
+
+// records are always encoded with msgpack,
+// message bodies are encoded with the codec of the queue
+var recordCodec = encoding.NewMsgPackCodec(nil)
+
+type operation uint8
+
+const (
+	opPublish operation = iota + 1
+	opAck
+	opReject
+	opSchedule
+	opReschedule
+	opUnschedule
+)
+
+type record struct {
+	Op       operation
+	ID       string
+	Message  *storedMessage   `msgpack:",omitempty"`
+	Due      time.Time        `msgpack:",omitempty"`
+	Messages []*storedMessage `msgpack:",omitempty"`
+}
+
+type storedMessage struct {
+	ID    string
+	Body  []byte
+	Props queue.Properties
+}
+
+type storedSchedule struct {
+	due      time.Time
+	messages []*storedMessage
+}
+
+// persistence appends the operations of a queue to a write-ahead log,
+// the log is compacted into a snapshot after every snapshotEvery records.
+// The state of the log is kept in memory so that snapshots can be taken without reading it
+type persistence struct {
+	mu            sync.Mutex
+	walPath       string
+	snapshotPath  string
+	snapshotEvery int
+
+	wal     *os.File
+	records int
+
+	// current state, pending messages are ordered by seq
+	seq       uint64
+	pending   map[string]*storedMessage
+	order     map[string]uint64
+	schedules map[string]*storedSchedule
+}
+
+func (p *persistence) published(m *storedMessage) error {
+	return p.append(&record{Op: opPublish, ID: m.ID, Message: m})
+}
+
+func (p *persistence) acked(id string) error {
+	return p.append(&record{Op: opAck, ID: id})
+}
+
+func (p *persistence) rejected(id string) error {
+	return p.append(&record{Op: opReject, ID: id})
+}
+
+func (p *persistence) scheduled(id string, due time.Time, messages []*storedMessage) error {
+	return p.append(&record{Op: opSchedule, ID: id, Due: due, Messages: messages})
+}
+
+func (p *persistence) rescheduled(id string, due time.Time) error {
+	return p.append(&record{Op: opReschedule, ID: id, Due: due})
+}
+
+// fired keeps the remaining messages of a schedule which is partially published
+func (p *persistence) fired(id string, remaining []*storedMessage) error {
+	p.mu.Lock()
+	s, ok := p.schedules[id]
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return p.scheduled(id, s.due, remaining)
+}
+
+func (p *persistence) unscheduled(id string) error {
+	return p.append(&record{Op: opUnschedule, ID: id})
+}
+
+func (p *persistence) append(r *record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wal == nil {
+		return fmt.Errorf("memq: persistence of %s is closed", p.walPath)
+	}
+
+	if err := writeRecord(p.wal, r); err != nil {
+		return err
+	}
+
+	p.apply(r)
+	p.records++
+
+	if p.snapshotEvery > 0 && p.records >= p.snapshotEvery {
+		return p.snapshot()
+	}
+
+	return nil
+}
+
+// apply the record to the in-memory state, replaying a record twice has no effect
+func (p *persistence) apply(r *record) {
+	switch r.Op {
+	case opPublish:
+		if _, ok := p.pending[r.ID]; !ok && r.Message != nil {
+			p.seq++
+			p.pending[r.ID] = r.Message
+			p.order[r.ID] = p.seq
+		}
+	case opAck:
+		delete(p.pending, r.ID)
+		delete(p.order, r.ID)
+	case opSchedule:
+		p.schedules[r.ID] = &storedSchedule{due: r.Due, messages: r.Messages}
+	case opReschedule:
+		if s, ok := p.schedules[r.ID]; ok {
+			s.due = r.Due
+		}
+	case opUnschedule:
+		delete(p.schedules, r.ID)
+	}
+}
+
+// snapshot writes the current state into the snapshot file and truncates the log,
+// the caller must hold mu
+func (p *persistence) snapshot() error {
+	tmp := p.snapshotPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, m := range p.pendingMessages() {
+		if err = writeRecord(w, &record{Op: opPublish, ID: m.ID, Message: m}); err != nil {
+			break
+		}
+	}
+	for id, s := range p.schedules {
+		if err != nil {
+			break
+		}
+		err = writeRecord(w, &record{Op: opSchedule, ID: id, Due: s.due, Messages: s.messages})
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("memq: write snapshot error: %s", err)
+	}
+
+	if err = os.Rename(tmp, p.snapshotPath); err != nil {
+		return fmt.Errorf("memq: write snapshot error: %s", err)
+	}
+
+	// the records of the log are all in the snapshot now
+	if err = p.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = p.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	p.records = 0
+	return nil
+}
+
+// pendingSchedules returns a copy of the schedules, which are fired
+// while they are recovered if they are due
+func (p *persistence) pendingSchedules() map[string]*storedSchedule {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	schedules := make(map[string]*storedSchedule, len(p.schedules))
+	for id, s := range p.schedules {
+		schedules[id] = s
+	}
+
+	return schedules
+}
+
+func (p *persistence) pendingMessages() []*storedMessage {
+	messages := make([]*storedMessage, 0, len(p.pending))
+	for _, m := range p.pending {
+		messages = append(messages, m)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return p.order[messages[i].ID] < p.order[messages[j].ID]
+	})
+
+	return messages
+}
+
+// recover loads the snapshot and replays the log
+func (p *persistence) recover() error {
+	if err := p.replay(p.snapshotPath, false); err != nil {
+		return err
+	}
+
+	p.records = 0
+	return p.replay(p.walPath, true)
+}
+
+func (p *persistence) replay(path string, truncate bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	r := bufio.NewReader(f)
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if truncate {
+				// the tail of the log was not completely written
+				return os.Truncate(path, offset)
+			}
+			return fmt.Errorf("memq: read %s error: %s", path, err)
+		}
+
+		p.apply(rec)
+		p.records++
+		offset += n
+	}
+}
+
+func (p *persistence) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wal == nil {
+		return nil
+	}
+
+	err := p.snapshot()
+	if cerr := p.wal.Close(); err == nil {
+		err = cerr
+	}
+
+	p.wal = nil
+	return err
+}
+
+func writeRecord(w io.Writer, r *record) error {
+	data, err := recordCodec.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+func readRecord(r io.Reader) (*record, int64, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, 0, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	rec := &record{}
+	if err := recordCodec.Unmarshal(data, rec); err != nil {
+		return nil, 0, err
+	}
+
+	return rec, int64(len(size) + len(data)), nil
+}
+
+func openPersistence(dir, name string, snapshotEvery int) (*persistence, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	base := filepath.Join(dir, url.PathEscape(name))
+	p := &persistence{
+		walPath:       base + ".wal",
+		snapshotPath:  base + ".snapshot",
+		snapshotEvery: snapshotEvery,
+		pending:       make(map[string]*storedMessage),
+		order:         make(map[string]uint64),
+		schedules:     make(map[string]*storedSchedule),
+	}
+
+	if err := p.recover(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(p.walPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.wal = wal
+
+	return p, nil
+}
@@ -0,0 +1,178 @@
+package memq_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/memq"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "memq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+// take returns the next n messages of the queue
+func take(q *memq.Queue, n int) []queue.Message {
+	var messages []queue.Message
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Daemon(ctx, func(m queue.Message) {
+		messages = append(messages, m)
+		if len(messages) == n {
+			cancel()
+		}
+	})
+
+	return messages
+}
+
+func values(t *testing.T, messages []queue.Message) []string {
+	var values []string
+	for _, m := range messages {
+		var v string
+		assert.Nil(t, m.Unmarshal(&v))
+		values = append(values, v)
+	}
+
+	return values
+}
+
+func TestPersistence(t *testing.T) {
+
+	t.Run("recover pending messages", func(t *testing.T) {
+		dir := tempDir(t)
+
+		q, err := memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, err)
+		assert.Nil(t, q.Publish("a", "b", "c", "d"))
+
+		messages := take(q, 3)
+		assert.Nil(t, messages[0].Ack())
+		assert.Nil(t, messages[1].Reject())
+		// the third message is taken but never acked
+		assert.NotNil(t, messages[2].Body())
+
+		// restart without closing
+		q, err = memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, err)
+		assert.Equal(t, 3, q.Size())
+		assert.Equal(t, []string{"b", "c", "d"}, values(t, take(q, 3)))
+	})
+
+	t.Run("recover delayed messages", func(t *testing.T) {
+		dir := tempDir(t)
+		clock := memq.NewMockClock(time.Now())
+
+		q, _ := memq.NewQueue("default", memq.WithPersistence(dir), memq.WithClock(clock))
+		cancelled, _ := q.At(clock.Now().Add(time.Minute), "cancelled")
+		rescheduled, _ := q.At(clock.Now().Add(time.Minute), "rescheduled")
+		assert.Nil(t, q.Later(time.Second, "delayed"))
+		assert.Nil(t, q.Cancel(cancelled))
+		assert.Nil(t, q.Reschedule(rescheduled, clock.Now().Add(time.Hour)))
+		assert.Nil(t, q.Close())
+
+		q, err := memq.NewQueue("default", memq.WithPersistence(dir), memq.WithClock(clock))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, q.Size())
+		assert.Equal(t, 2, q.Delayed())
+
+		clock.Add(time.Minute)
+		assertSize(t, q, 1)
+		assert.Equal(t, 1, q.Delayed())
+
+		clock.Add(time.Hour)
+		assertSize(t, q, 2)
+		assert.Equal(t, []string{"delayed", "rescheduled"}, values(t, take(q, 2)))
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		dir := tempDir(t)
+
+		q, _ := memq.NewQueue("default", memq.WithPersistence(dir), memq.WithSnapshotEvery(3))
+		assert.Nil(t, q.Publish("a", "b", "c", "d", "e"))
+		for _, m := range take(q, 2) {
+			assert.Nil(t, m.Ack())
+		}
+
+		q, err := memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"c", "d", "e"}, values(t, take(q, 3)))
+	})
+
+	t.Run("partially written log", func(t *testing.T) {
+		dir := tempDir(t)
+
+		q, _ := memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, q.Publish("a"))
+
+		f, err := os.OpenFile(filepath.Join(dir, "default.wal"), os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		f.Write([]byte{0, 0, 1})
+		f.Close()
+
+		q, err = memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, err)
+		assert.Nil(t, q.Publish("b"))
+
+		q, err = memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a", "b"}, values(t, take(q, 2)))
+	})
+
+	t.Run("recover more than buffer size", func(t *testing.T) {
+		dir := tempDir(t)
+
+		q, _ := memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, q.Publish("a", "b", "c"))
+
+		q, err := memq.NewQueue("default", memq.WithPersistence(dir), memq.WithBufferSize(1))
+		assert.Nil(t, err)
+		assert.Equal(t, 3, q.Size())
+	})
+
+	t.Run("reject when full", func(t *testing.T) {
+		dir := tempDir(t)
+
+		opts := []memq.Option{memq.WithPersistence(dir), memq.WithBufferSize(1), memq.WithOverflow(memq.Fail)}
+		q, _ := memq.NewQueue("default", opts...)
+		assert.Nil(t, q.Publish("a"))
+		m := take(q, 1)[0]
+		assert.Nil(t, q.Publish("b"))
+		assert.Nil(t, m.Reject())
+
+		q, err := memq.NewQueue("default", opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, q.Size())
+	})
+
+	t.Run("partially published delayed messages", func(t *testing.T) {
+		dir := tempDir(t)
+
+		q, _ := memq.NewQueue("default", memq.WithPersistence(dir), memq.WithBufferSize(1), memq.WithOverflow(memq.Fail))
+		assert.Nil(t, q.Later(time.Millisecond, "a", "b"))
+		// only a fits in the buffer
+		assertSize(t, q, 1)
+		time.Sleep(10 * time.Millisecond)
+
+		// b is published after the restart, a is not replayed
+		q, err := memq.NewQueue("default", memq.WithPersistence(dir))
+		assert.Nil(t, err)
+		assertSize(t, q, 2)
+		assert.ElementsMatch(t, []string{"a", "b"}, values(t, take(q, 2)))
+	})
+}
@@ -0,0 +1,201 @@
+package memq
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal/logger"
+)
+
+var ErrTooManyDelayed = errors.New("memq: too many delayed messages")
+
+// scheduler publishes delayed messages when they are due,
+// it uses a min-heap of due times and a single goroutine,
+// which only runs while there are delayed messages
+type scheduler struct {
+	mu    sync.Mutex
+	clock Clock
+	limit int
+	fire  func(id string, messages []*Message) error
+
+	entries delayHeap
+	byID    map[string]*delayed
+	// number of delayed messages of all entries
+	size    int
+	running bool
+	// wake is signaled when the earliest due time may have changed
+	wake chan struct{}
+}
+
+type delayed struct {
+	id       string
+	due      time.Time
+	messages []*Message
+	index    int
+}
+
+// add schedules the messages at the given time
+func (s *scheduler) add(id string, due time.Time, messages []*Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limit > 0 && s.size+len(messages) > s.limit {
+		return ErrTooManyDelayed
+	}
+
+	d := &delayed{id: id, due: due, messages: messages}
+	heap.Push(&s.entries, d)
+	s.byID[id] = d
+	s.size += len(messages)
+
+	s.changed()
+	return nil
+}
+
+// remove the scheduled messages before they are due
+func (s *scheduler) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.byID[id]
+	if !ok {
+		return queue.ErrScheduleNotFound
+	}
+
+	heap.Remove(&s.entries, d.index)
+	delete(s.byID, id)
+	s.size -= len(d.messages)
+
+	s.changed()
+	return nil
+}
+
+// reschedule changes the due time of the scheduled messages
+func (s *scheduler) reschedule(id string, due time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.byID[id]
+	if !ok {
+		return queue.ErrScheduleNotFound
+	}
+
+	d.due = due
+	heap.Fix(&s.entries, d.index)
+
+	s.changed()
+	return nil
+}
+
+// len returns the number of delayed messages
+func (s *scheduler) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// next returns the earliest due time
+func (s *scheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries.Len() == 0 {
+		return time.Time{}, false
+	}
+
+	return s.entries[0].due, true
+}
+
+// changed starts the goroutine or wakes it up to recalculate the waiting time,
+// the caller must hold mu
+func (s *scheduler) changed() {
+	if !s.running {
+		if s.entries.Len() > 0 {
+			s.running = true
+			go s.run()
+		}
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) run() {
+	for {
+		s.mu.Lock()
+		if s.entries.Len() == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+
+		d := s.entries[0]
+		if !d.due.After(s.clock.Now()) {
+			heap.Pop(&s.entries)
+			delete(s.byID, d.id)
+			s.size -= len(d.messages)
+			s.mu.Unlock()
+
+			if err := s.fire(d.id, d.messages); err != nil {
+				logger.Errorf("memq: publish delayed messages %s error %s", d.id, err)
+			}
+			continue
+		}
+		s.mu.Unlock()
+
+		timer := s.clock.NewTimerAt(d.due)
+		select {
+		case <-timer.C():
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+func newScheduler(clock Clock, limit int, fire func(id string, messages []*Message) error) *scheduler {
+	return &scheduler{
+		clock: clock,
+		limit: limit,
+		fire:  fire,
+		byID:  make(map[string]*delayed),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+//
+// Delay heap
+//
+
+type delayHeap []*delayed
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+
+func (h delayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *delayHeap) Push(x interface{}) {
+	d := x.(*delayed)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	d := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return d
+}
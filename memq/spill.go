@@ -0,0 +1,217 @@
+package memq
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// spill keeps the messages overflowing the buffer in a file,
+// they are read back in publishing order when there is room in the buffer
+type spill struct {
+	mu    sync.Mutex
+	path  string
+	w     *os.File
+	r     *os.File
+	count int
+	// the earliest message, which has been read but not removed
+	head *storedMessage
+	// messages deleted before being read back
+	deleted map[string]bool
+}
+
+func (s *spill) push(m *storedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeRecord(s.w, &record{Op: opPublish, ID: m.ID, Message: m}); err != nil {
+		return err
+	}
+
+	s.count++
+	return nil
+}
+
+// peek returns the earliest spilled message without removing it,
+// or nil if there is none
+func (s *spill) peek() (*storedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 {
+		return nil, nil
+	}
+
+	for s.head == nil {
+		rec, _, err := readRecord(s.r)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.deleted[rec.ID] {
+			delete(s.deleted, rec.ID)
+			continue
+		}
+		s.head = rec.Message
+	}
+
+	return s.head, nil
+}
+
+// pop removes the message returned by peek
+func (s *spill) pop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.head == nil {
+		return nil
+	}
+
+	s.head = nil
+	s.count--
+	if s.count > 0 {
+		return nil
+	}
+
+	return s.rewind()
+}
+
+// list returns the spilled messages in publishing order
+func (s *spill) list() ([]*storedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remaining()
+}
+
+// remove deletes the spilled message with the given id,
+// it returns false if there is no such message
+func (s *spill) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages, err := s.remaining()
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range messages {
+		if m.ID != id {
+			continue
+		}
+
+		if s.head == m {
+			s.head = nil
+		} else {
+			s.deleted[id] = true
+		}
+
+		s.count--
+		if s.count == 0 {
+			return true, s.rewind()
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// reset discards all spilled messages
+func (s *spill) reset() ([]*storedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages, err := s.remaining()
+	if err != nil {
+		return nil, err
+	}
+
+	s.head = nil
+	s.count = 0
+	return messages, s.rewind()
+}
+
+// remaining reads the messages which have not been read back without moving the reader,
+// the caller must hold mu
+func (s *spill) remaining() ([]*storedMessage, error) {
+	messages := make([]*storedMessage, 0, s.count)
+	if s.count == 0 {
+		return messages, nil
+	}
+
+	if s.head != nil {
+		messages = append(messages, s.head)
+	}
+
+	offset, err := s.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	for len(messages) < s.count {
+		rec, _, err := readRecord(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !s.deleted[rec.ID] {
+			messages = append(messages, rec.Message)
+		}
+	}
+
+	return messages, nil
+}
+
+// rewind empties the file when everything has been read back,
+// the caller must hold mu
+func (s *spill) rewind() error {
+	s.deleted = make(map[string]bool)
+	if err := s.w.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := s.r.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *spill) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.count
+}
+
+func openSpill(dir, name string) (*spill, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, url.PathEscape(name)+".spill")
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return &spill{path: path, w: w, r: r, deleted: make(map[string]bool)}, nil
+}
@@ -16,3 +16,73 @@ type Message interface {
 	Ack() error
 	Status() MessageStatus
 }
+
+//
+// Message properties
+//
+
+// Properties are published alongside the message body
+type Properties struct {
+	// Type is the name of the message type,
+	// Dispatch fills it with the Go type name of the message
+	Type string
+	// CorrelationID identifies the call which the message belongs to
+	CorrelationID string
+	// ReplyTo is the address where the reply should be sent
+	ReplyTo string
+	// Priority of the message, higher priority messages are delivered first
+	Priority uint8
+	// Headers are application defined values,
+	// backends may reserve names prefixed by "x-"
+	Headers map[string]interface{}
+}
+
+// Envelope wraps a message body with its properties,
+// backends publish the Body and carry the Properties along with it
+type Envelope struct {
+	Properties
+	Body interface{}
+}
+
+// PropertiesCarrier is implemented by messages
+// that carry the properties they were published with
+type PropertiesCarrier interface {
+	Properties() Properties
+}
+
+// PropertiesOf returns the properties of the message,
+// or empty properties if the backend does not support them
+func PropertiesOf(m Message) Properties {
+	if c, ok := m.(PropertiesCarrier); ok {
+		return c.Properties()
+	}
+
+	return Properties{}
+}
+
+// Unwrap splits a published value into its body and properties
+func Unwrap(v interface{}) (interface{}, Properties) {
+	switch e := v.(type) {
+	case *Envelope:
+		return e.Body, e.Properties
+	case Envelope:
+		return e.Body, e.Properties
+	}
+
+	return v, Properties{}
+}
+
+// Identifier is implemented by messages that have an id assigned by the backend
+type Identifier interface {
+	ID() string
+}
+
+// IDOf returns the id of the message,
+// or an empty string if the backend does not support it
+func IDOf(m Message) string {
+	if i, ok := m.(Identifier); ok {
+		return i.ID()
+	}
+
+	return ""
+}
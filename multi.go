@@ -0,0 +1,206 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ibllex/go-queue/internal/logger"
+)
+
+// Strategy decides which queue the next message is taken from
+type Strategy int
+
+const (
+	// StrictPriority always takes messages from the first queue that has messages
+	StrictPriority Strategy = iota
+	// WeightedRoundRobin takes messages from queues in proportion to their weights
+	WeightedRoundRobin
+)
+
+// Source is a queue consumed by a multi-queue consumer
+type Source struct {
+	Queue WorkerQueue
+	// Weight is only used by WeightedRoundRobin, default is 1
+	Weight int
+}
+
+// multiWorker draws messages from several workers,
+// so that they can share the worker pool of one consumer
+type multiWorker struct {
+	strategy Strategy
+	workers  []Worker
+	weights  []int
+	// current weights of the smooth weighted round-robin
+	current []int
+}
+
+func (w *multiWorker) Name() string {
+	names := make([]string, len(w.workers))
+	for i, worker := range w.workers {
+		names[i] = worker.Name()
+	}
+
+	return strings.Join(names, ",")
+}
+
+func (w *multiWorker) Daemon(ctx context.Context, handler HandlerFunc) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	errs := make(chan error, len(w.workers))
+	sources := make([]chan Message, len(w.workers))
+
+	for i, worker := range w.workers {
+		sources[i] = make(chan Message)
+
+		wg.Add(1)
+		go func(worker Worker, source chan Message) {
+			defer wg.Done()
+			errs <- worker.Daemon(ctx, func(m Message) {
+				select {
+				case source <- m:
+				case <-ctx.Done():
+					// nobody is going to process the message, hand it back
+					logger.LogIfError(m.Reject())
+				}
+			})
+		}(worker, sources[i])
+	}
+
+	// cases for blocking selection, the sources follow ctx and errs
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(errs)},
+	}
+	for _, source := range sources {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(source)})
+	}
+
+	for {
+		order := w.order()
+		i, m := poll(sources, order)
+
+		if m == nil {
+			chosen, v, _ := reflect.Select(cases)
+			switch chosen {
+			case 0:
+				return nil
+			case 1:
+				if err, _ := v.Interface().(error); err != nil {
+					return err
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("multi-queue consumer: worker exited")
+			default:
+				i, m = chosen-2, v.Interface().(Message)
+			}
+		}
+
+		w.taken(i)
+		handler(m)
+	}
+}
+
+// order returns the indexes of workers in the order they should be polled
+func (w *multiWorker) order() []int {
+	order := make([]int, len(w.workers))
+	for i := range order {
+		order[i] = i
+	}
+
+	if w.strategy != WeightedRoundRobin {
+		return order
+	}
+
+	for i, weight := range w.weights {
+		w.current[i] += weight
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return w.current[order[a]] > w.current[order[b]]
+	})
+
+	return order
+}
+
+// taken records that a message has been taken from the worker i
+func (w *multiWorker) taken(i int) {
+	if w.strategy != WeightedRoundRobin {
+		return
+	}
+
+	total := 0
+	for _, weight := range w.weights {
+		total += weight
+	}
+
+	w.current[i] -= total
+
+	// the weights of idle workers are added every round as well, the credit they build up,
+	// and the debt of the others, is limited to a round so that they do not starve the others later
+	for j := range w.current {
+		if w.current[j] > total {
+			w.current[j] = total
+		} else if w.current[j] < -total {
+			w.current[j] = -total
+		}
+	}
+}
+
+// poll returns the first available message without blocking
+func poll(sources []chan Message, order []int) (int, Message) {
+	for _, i := range order {
+		select {
+		case m := <-sources[i]:
+			return i, m
+		default:
+		}
+	}
+
+	return -1, nil
+}
+
+// NewMultiConsumer creates a consumer which draws messages from several queues,
+// all messages are processed by the same worker pool and handler
+func NewMultiConsumer(strategy Strategy, opt *ConsumerOption, sources ...Source) (*Consumer, error) {
+
+	if len(sources) == 0 {
+		return nil, errors.New("no queue to consume")
+	}
+
+	opt = DefaultConsumerOption(opt)
+
+	w := &multiWorker{
+		strategy: strategy,
+		workers:  make([]Worker, len(sources)),
+		weights:  make([]int, len(sources)),
+		current:  make([]int, len(sources)),
+	}
+
+	for i, source := range sources {
+		if source.Queue == nil {
+			return nil, fmt.Errorf("queue of source %d is nil", i)
+		}
+
+		w.workers[i] = source.Queue.Worker(opt)
+		w.weights[i] = source.Weight
+		if w.weights[i] <= 0 {
+			w.weights[i] = 1
+		}
+	}
+
+	return NewConsumer(w, opt)
+}
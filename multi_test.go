@@ -0,0 +1,165 @@
+package queue_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/memq"
+	"github.com/stretchr/testify/assert"
+)
+
+func consumeMulti(t *testing.T, strategy queue.Strategy, n int, sources ...queue.Source) []string {
+	var mu sync.Mutex
+	var names []string
+	done := make(chan bool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := queue.NewMultiConsumer(strategy, &queue.ConsumerOption{
+		MaxNumWorker: 1,
+		Handler: queue.H(func(m queue.Message) {
+			var v string
+			assert.Nil(t, m.Unmarshal(&v))
+			// give the workers time to fetch from all the queues
+			time.Sleep(20 * time.Millisecond)
+			m.Ack()
+
+			mu.Lock()
+			defer mu.Unlock()
+			names = append(names, v)
+			if len(names) == n {
+				done <- true
+			}
+		}),
+	}, sources...)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Start(ctx))
+
+	<-done
+
+	// more messages may be handled before the consumer stops
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]string(nil), names[:n]...)
+}
+
+func TestMultiConsumer(t *testing.T) {
+
+	t.Run("strict priority", func(t *testing.T) {
+		high, _ := memq.NewQueue("high")
+		low, _ := memq.NewQueue("low")
+		low.Publish("low", "low", "low")
+		high.Publish("high", "high", "high")
+
+		names := consumeMulti(t, queue.StrictPriority, 6,
+			queue.Source{Queue: high},
+			queue.Source{Queue: low},
+		)
+
+		// the first message is taken from whichever worker is ready first
+		if names[0] == "low" {
+			assert.Equal(t, []string{"high", "high", "high", "low", "low"}, names[1:])
+		} else {
+			assert.Equal(t, []string{"high", "high", "low", "low", "low"}, names[1:])
+		}
+	})
+
+	t.Run("weighted round robin", func(t *testing.T) {
+		high, _ := memq.NewQueue("high")
+		low, _ := memq.NewQueue("low")
+		for i := 0; i < 8; i++ {
+			low.Publish("low")
+			high.Publish("high")
+		}
+
+		names := consumeMulti(t, queue.WeightedRoundRobin, 8,
+			queue.Source{Queue: high, Weight: 3},
+			queue.Source{Queue: low, Weight: 1},
+		)
+		counts := map[string]int{}
+		for _, name := range names {
+			counts[name]++
+		}
+		assert.Equal(t, map[string]int{"high": 6, "low": 2}, counts)
+	})
+
+	t.Run("idle queue", func(t *testing.T) {
+		high, _ := memq.NewQueue("high")
+		low, _ := memq.NewQueue("low")
+
+		names := make(chan string, 100)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c, err := queue.NewMultiConsumer(queue.WeightedRoundRobin, &queue.ConsumerOption{
+			MaxNumWorker: 1,
+			Handler: queue.H(func(m queue.Message) {
+				var v string
+				assert.Nil(t, m.Unmarshal(&v))
+				// give the workers time to fetch from all the queues
+				time.Sleep(5 * time.Millisecond)
+				m.Ack()
+				names <- v
+			}),
+		}, queue.Source{Queue: high, Weight: 3}, queue.Source{Queue: low, Weight: 1})
+		assert.Nil(t, err)
+		assert.Nil(t, c.Start(ctx))
+
+		// the low queue is idle while the high one is consumed
+		for i := 0; i < 30; i++ {
+			high.Publish("high")
+		}
+		for i := 0; i < 30; i++ {
+			<-names
+		}
+
+		for i := 0; i < 8; i++ {
+			high.Publish("high")
+			low.Publish("low")
+		}
+
+		counts := map[string]int{}
+		for i := 0; i < 8; i++ {
+			select {
+			case name := <-names:
+				counts[name]++
+			case <-time.After(time.Second):
+				t.Fatal("messages are not consumed")
+			}
+		}
+
+		// the first message may be taken before the other queue is loaded
+		assert.InDelta(t, 6, counts["high"], 1)
+	})
+
+	t.Run("no queues", func(t *testing.T) {
+		_, err := queue.NewMultiConsumer(queue.StrictPriority, nil)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		high, _ := memq.NewQueue("high")
+		low, _ := memq.NewQueue("low")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c, err := queue.NewMultiConsumer(queue.StrictPriority, nil,
+			queue.Source{Queue: high},
+			queue.Source{Queue: low},
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, c.Start(ctx))
+
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+
+		high.Publish("high")
+		low.Publish("low")
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, 1, high.Size())
+		assert.Equal(t, 1, low.Size())
+	})
+}
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/ibllex/go-queue/internal/logger"
@@ -20,10 +21,18 @@ type Worker interface {
 	Daemon(ctx context.Context, handler HandlerFunc) error
 }
 
+// WorkerQueue is implemented by queues which can create workers
+// for consumers that draw from several queues, see NewMultiConsumer
+type WorkerQueue interface {
+	Queue
+	Worker(opt *ConsumerOption) Worker
+}
+
 //
 // Queue
 //
 
+// Queue is implemented by the backends
 type Queue interface {
 	Name() string
 	Size() int
@@ -33,3 +42,51 @@ type Queue interface {
 	Later(delay time.Duration, messages ...interface{}) error
 	// Fetch(ctx context.Context, prefetchCount int) ([]Message, error)
 }
+
+// PropertiesPublisher is implemented by queues which publish the body of the *Envelope
+// values passed to Publish and Later, see Unwrap, and carry their Properties along with it.
+// Dispatch only wraps messages for these queues, the others get the messages as they are
+type PropertiesPublisher interface {
+	Queue
+	CarriesProperties() bool
+}
+
+//
+// Scheduler
+//
+
+var ErrScheduleNotFound = errors.New("scheduled messages not found")
+
+// Scheduler is implemented by queues whose delayed messages
+// can be cancelled or rescheduled before delivery
+type Scheduler interface {
+	// At publishes the messages at the given time,
+	// the returned id can be used to cancel or reschedule them
+	At(t time.Time, messages ...interface{}) (string, error)
+	// Cancel the scheduled messages, ErrScheduleNotFound is returned
+	// if they have been delivered or the id is unknown
+	Cancel(id string) error
+	// Reschedule the messages to be published at the given time
+	Reschedule(id string, t time.Time) error
+}
+
+//
+// Inspector
+//
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// Inspector is implemented by queues whose waiting messages
+// can be looked at without consuming them, it is meant for debugging.
+// The returned messages are snapshots, they can not be acked or rejected
+type Inspector interface {
+	// Peek returns up to n messages in delivery order
+	Peek(n int) ([]Message, error)
+	// List returns up to limit messages in delivery order, skipping the first offset messages
+	List(offset, limit int) ([]Message, error)
+	// Delete removes the waiting message with the given id, see IDOf,
+	// ErrMessageNotFound is returned if there is no such message
+	Delete(id string) error
+	// Purge removes all waiting messages
+	Purge() error
+}
@@ -0,0 +1,342 @@
+// Package queuetest holds the conformance suite which every queue backend should pass,
+// call RunConformance from the tests of the backend:
+//
+//	func TestConformance(t *testing.T) {
+//		queuetest.RunConformance(t, func(t *testing.T) queue.Queue {
+//			q, _ := memq.NewQueue(t.Name())
+//			return q
+//		})
+//	}
+package queuetest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// Timeout of waiting for the backend, published messages must be visible
+// and consumed within it
+var Timeout = 5 * time.Second
+
+// Factory creates an empty queue for every test of the suite,
+// use t.Cleanup to release it
+type Factory func(t *testing.T) queue.Queue
+
+// RunConformance runs the conformance suite against the queues created by the factory.
+// Messages are integers, so the codec of the backend must be able to encode them
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, q queue.Queue)
+	}{
+		{"publish and size", testPublish},
+		{"later", testLater},
+		{"envelope", testEnvelope},
+		{"ack", testAck},
+		{"reject", testReject},
+		{"status transitions", testStatus},
+		{"concurrency limit", testConcurrency},
+		{"prefetch", testPrefetch},
+		{"shutdown", testShutdown},
+		{"start twice", testStartTwice},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory(t))
+		})
+	}
+}
+
+func assertSize(t *testing.T, q queue.Queue, size int) bool {
+	return assert.Eventually(t, func() bool {
+		return q.Size() == size
+	}, Timeout, 10*time.Millisecond, "size of the queue should be %d", size)
+}
+
+// consume starts a consumer of the queue, it is stopped when the test is done
+func consume(t *testing.T, q queue.Queue, opt *queue.ConsumerOption) context.CancelFunc {
+	c, err := q.Consumer(opt)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	assert.Nil(t, c.Start(ctx))
+	return cancel
+}
+
+func value(t *testing.T, m queue.Message) int {
+	var v int
+	assert.Nil(t, m.Unmarshal(&v))
+	return v
+}
+
+func testPublish(t *testing.T, q queue.Queue) {
+	assert.Equal(t, 0, q.Size())
+
+	assert.Nil(t, q.Publish(0, 1, 2))
+	assertSize(t, q, 3)
+
+	assert.Nil(t, q.Publish(3))
+	assertSize(t, q, 4)
+}
+
+func testLater(t *testing.T, q queue.Queue) {
+	assert.Nil(t, q.Later(200*time.Millisecond, 1))
+	assert.Equal(t, 0, q.Size(), "delayed messages should not be visible before they are due")
+
+	assertSize(t, q, 1)
+}
+
+// testEnvelope checks that wrapped messages, e.g. published by Dispatch, are unwrapped
+// by the queues which implement queue.PropertiesPublisher
+func testEnvelope(t *testing.T, q queue.Queue) {
+	if p, ok := q.(queue.PropertiesPublisher); !ok || !p.CarriesProperties() {
+		t.Skip("the queue does not carry properties")
+	}
+
+	assert.Nil(t, q.Publish(&queue.Envelope{Properties: queue.Properties{Type: "int"}, Body: 1}))
+	assert.Nil(t, q.Later(10*time.Millisecond, &queue.Envelope{Body: 2}))
+
+	var mu sync.Mutex
+	var received []int
+	consume(t, q, &queue.ConsumerOption{
+		Handler: queue.H(func(m queue.Message) {
+			assert.Nil(t, m.Ack())
+
+			mu.Lock()
+			received = append(received, value(t, m))
+			mu.Unlock()
+		}),
+	})
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	}, Timeout, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.ElementsMatch(t, []int{1, 2}, received)
+}
+
+func testAck(t *testing.T, q queue.Queue) {
+	assert.Nil(t, q.Publish(0, 1, 2))
+
+	var mu sync.Mutex
+	received := map[int]int{}
+	consume(t, q, &queue.ConsumerOption{
+		Handler: queue.H(func(m queue.Message) {
+			assert.Nil(t, m.Ack())
+
+			mu.Lock()
+			received[value(t, m)]++
+			mu.Unlock()
+		}),
+	})
+
+	assertSize(t, q, 0)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3
+	}, Timeout, 10*time.Millisecond)
+
+	// acked messages are never delivered again
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[int]int{0: 1, 1: 1, 2: 1}, received)
+}
+
+func testReject(t *testing.T, q queue.Queue) {
+	assert.Nil(t, q.Publish(1))
+
+	var deliveries int32
+	done := make(chan struct{})
+	consume(t, q, &queue.ConsumerOption{
+		MaxNumWorker: 1,
+		Handler: queue.H(func(m queue.Message) {
+			assert.Equal(t, 1, value(t, m))
+
+			// rejected messages are delivered again
+			if atomic.AddInt32(&deliveries, 1) == 1 {
+				assert.Nil(t, m.Reject())
+				return
+			}
+
+			assert.Nil(t, m.Ack())
+			close(done)
+		}),
+	})
+
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+		t.Fatal("rejected message is not delivered again")
+	}
+
+	assertSize(t, q, 0)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&deliveries))
+}
+
+func testStatus(t *testing.T, q queue.Queue) {
+	assert.Nil(t, q.Publish(0, 1))
+
+	var rejected int32
+	messages := make(chan queue.Message, 2)
+	consume(t, q, &queue.ConsumerOption{
+		MaxNumWorker: 1,
+		Handler: queue.H(func(m queue.Message) {
+			assert.Equal(t, queue.Pending, m.Status())
+
+			switch {
+			case value(t, m) == 0:
+				assert.Nil(t, m.Ack())
+				assert.Equal(t, queue.Acked, m.Status())
+				assert.NotNil(t, m.Reject(), "acked messages can not be rejected")
+				assert.Equal(t, queue.Acked, m.Status())
+				messages <- m
+			case atomic.CompareAndSwapInt32(&rejected, 0, 1):
+				assert.Nil(t, m.Reject())
+				assert.Equal(t, queue.Rejected, m.Status())
+				assert.NotNil(t, m.Ack(), "rejected messages can not be acked")
+				assert.Equal(t, queue.Rejected, m.Status())
+				messages <- m
+			default:
+				// the rejected message is delivered again
+				assert.Nil(t, m.Ack())
+			}
+		}),
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-messages:
+		case <-time.After(Timeout):
+			t.Fatal("messages are not delivered")
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, q queue.Queue) {
+	const n, workers = 10, 2
+
+	for i := 0; i < n; i++ {
+		assert.Nil(t, q.Publish(i))
+	}
+	assertSize(t, q, n)
+
+	var running, max, processed int32
+	consume(t, q, &queue.ConsumerOption{
+		MaxNumWorker: workers,
+		Handler: queue.H(func(m queue.Message) {
+			r := atomic.AddInt32(&running, 1)
+			for {
+				v := atomic.LoadInt32(&max)
+				if r <= v || atomic.CompareAndSwapInt32(&max, v, r) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			assert.Nil(t, m.Ack())
+			atomic.AddInt32(&processed, 1)
+		}),
+	})
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&processed) == n
+	}, Timeout, 10*time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt32(&max), int32(workers), "too many messages are processed concurrently")
+}
+
+func testPrefetch(t *testing.T, q queue.Queue) {
+	const n = 10
+
+	for i := 0; i < n; i++ {
+		assert.Nil(t, q.Publish(i))
+	}
+	assertSize(t, q, n)
+
+	gate := make(chan struct{})
+	defer close(gate)
+
+	var received int32
+	consume(t, q, &queue.ConsumerOption{
+		MaxNumWorker:  1,
+		PrefetchCount: 1,
+		Handler: queue.H(func(m queue.Message) {
+			atomic.AddInt32(&received, 1)
+			<-gate
+			m.Ack()
+		}),
+	})
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&received) == 1
+	}, Timeout, 10*time.Millisecond)
+
+	// a blocked worker holds at most the message in hand and the prefetched ones
+	time.Sleep(100 * time.Millisecond)
+	assert.GreaterOrEqual(t, q.Size(), n-2, "too many messages are taken out of the queue")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func testShutdown(t *testing.T, q queue.Queue) {
+	const n = 5
+
+	for i := 0; i < n; i++ {
+		assert.Nil(t, q.Publish(i))
+	}
+	assertSize(t, q, n)
+
+	gate := make(chan struct{})
+	var received, acked int32
+	stop := consume(t, q, &queue.ConsumerOption{
+		MaxNumWorker: 1,
+		Handler: queue.H(func(m queue.Message) {
+			atomic.AddInt32(&received, 1)
+			<-gate
+			if m.Ack() == nil {
+				atomic.AddInt32(&acked, 1)
+			}
+		}),
+	})
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&received) == 1
+	}, Timeout, 10*time.Millisecond)
+
+	stop()
+	close(gate)
+
+	// no message is handed to the handler after shutdown,
+	// and the messages which are not acked stay in the queue
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+	assertSize(t, q, n-int(atomic.LoadInt32(&acked)))
+}
+
+func testStartTwice(t *testing.T, q queue.Queue) {
+	c, err := q.Consumer(nil)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, c.Start(ctx))
+	assert.NotNil(t, c.Start(ctx))
+}
@@ -0,0 +1,685 @@
+package amqptest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ibllex/go-queue/internal"
+)
+
+// delivery is a message delivered to the client which has not been acked yet
+type delivery struct {
+	tag uint64
+	m   *message
+	q   *queue
+	// c is nil for basic.get
+	c *consumer
+}
+
+// publishing is the content being received from the client
+type publishing struct {
+	exchange   string
+	routingKey string
+	mandatory  bool
+	size       uint64
+	m          *message
+}
+
+// channel state is guarded by the server lock
+type channel struct {
+	id uint16
+	c  *conn
+	// waiting for the client to confirm the close
+	closing bool
+
+	consumers map[string]*consumer
+	unacked   []*delivery
+	nextTag   uint64
+
+	// prefetch of new consumers, and of the whole channel
+	prefetch       int
+	prefetchGlobal int
+
+	confirm    bool
+	publishSeq uint64
+	publishing *publishing
+}
+
+func newChannel(c *conn, id uint16) *channel {
+	return &channel{
+		id:        id,
+		c:         c,
+		consumers: make(map[string]*consumer),
+	}
+}
+
+func (ch *channel) handle(class, method uint16, d *decoder) *amqpError {
+	if ch.publishing != nil {
+		return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - expected content header", hard: true}
+	}
+
+	var err *amqpError
+	switch class<<8 | method {
+	case classChannel<<8 | 20: // flow
+		active := d.bits(1)[0]
+		ch.c.sendMethod(ch.id, newMethod(classChannel, 21).bits(active))
+	case classChannel<<8 | 40: // close
+		ch.cleanup()
+		delete(ch.c.channels, ch.id)
+		ch.c.sendMethod(ch.id, newMethod(classChannel, 41))
+	case classExchange<<8 | 10:
+		err = ch.exchangeDeclare(d)
+	case classExchange<<8 | 20:
+		err = ch.exchangeDelete(d)
+	case classQueue<<8 | 10:
+		err = ch.queueDeclare(d)
+	case classQueue<<8 | 20:
+		err = ch.queueBind(d)
+	case classQueue<<8 | 50:
+		err = ch.queueUnbind(d)
+	case classQueue<<8 | 30:
+		err = ch.queuePurge(d)
+	case classQueue<<8 | 40:
+		err = ch.queueDelete(d)
+	case classBasic<<8 | 10:
+		err = ch.basicQos(d)
+	case classBasic<<8 | 20:
+		err = ch.basicConsume(d)
+	case classBasic<<8 | 30:
+		err = ch.basicCancel(d)
+	case classBasic<<8 | 40:
+		err = ch.basicPublish(d)
+	case classBasic<<8 | 70:
+		err = ch.basicGet(d)
+	case classBasic<<8 | 80: // ack
+		tag, multiple := d.longlong(), d.bits(1)[0]
+		err = ch.settle(tag, multiple, func(dl *delivery) {})
+	case classBasic<<8 | 90: // reject
+		tag, requeue := d.longlong(), d.bits(1)[0]
+		err = ch.settle(tag, false, ch.nack(requeue))
+	case classBasic<<8 | 120: // nack
+		tag, bits := d.longlong(), d.bits(2)
+		err = ch.settle(tag, bits[0], ch.nack(bits[1]))
+	case classBasic<<8 | 100, classBasic<<8 | 110: // recover-async, recover
+		ch.recover()
+		if method == 110 {
+			ch.c.sendMethod(ch.id, newMethod(classBasic, 111))
+		}
+	case classConfirm<<8 | 10:
+		ch.confirm = true
+		if nowait := d.bits(1)[0]; !nowait {
+			ch.c.sendMethod(ch.id, newMethod(classConfirm, 11))
+		}
+	default:
+		return &amqpError{code: replyNotImplemented, text: fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d", class, method), hard: true}
+	}
+
+	if err == nil && d.err != nil {
+		err = &amqpError{code: replyFrameError, text: "FRAME_ERROR - " + d.err.Error(), hard: true}
+	}
+
+	return err
+}
+
+// fail closes the channel with the error
+func (ch *channel) fail(err *amqpError) {
+	ch.cleanup()
+	ch.closing = true
+	ch.c.sendMethod(ch.id, newMethod(classChannel, 40).
+		short(err.code).shortstr(err.text).short(err.class).short(err.method))
+}
+
+// cleanup cancels the consumers and requeues the unacked messages
+func (ch *channel) cleanup() {
+	for _, c := range ch.consumers {
+		c.q.removeConsumer(c)
+	}
+	ch.consumers = map[string]*consumer{}
+	ch.publishing = nil
+
+	ch.recover()
+}
+
+//
+// Exchange methods
+//
+
+func (ch *channel) exchangeDeclare(d *decoder) *amqpError {
+	d.short()
+	name, kind := d.shortstr(), d.shortstr()
+	bits := d.bits(5)
+	passive, durable, autoDelete, internal, noWait := bits[0], bits[1], bits[2], bits[3], bits[4]
+	args := d.table()
+
+	s := ch.c.s
+	e, ok := s.exchanges[name]
+
+	switch {
+	case name == "":
+		return &amqpError{code: replyAccessRefused, text: "ACCESS_REFUSED - operation not permitted on the default exchange"}
+	case ok && !passive && !e.equivalent(kind, durable, autoDelete, internal, args):
+		return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for exchange '%s' in vhost '/'", name)}
+	case ok:
+	case passive:
+		return &amqpError{code: replyNotFound, text: fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", name)}
+	case strings.HasPrefix(name, "amq."):
+		return &amqpError{code: replyAccessRefused, text: fmt.Sprintf("ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)}
+	case !validKind(kind):
+		return &amqpError{code: replyCommandInvalid, text: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind), hard: true}
+	case kind == kindDelayed && !validDelayedType(args["x-delayed-type"]):
+		return &amqpError{code: replyPreconditionFail, text: "PRECONDITION_FAILED - Invalid argument, 'x-delayed-type' must be an existing exchange type"}
+	default:
+		s.exchanges[name] = &exchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete, internal: internal, args: args}
+	}
+
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classExchange, 11))
+	}
+
+	return nil
+}
+
+func (ch *channel) exchangeDelete(d *decoder) *amqpError {
+	d.short()
+	name, bits := d.shortstr(), d.bits(2)
+	ifUnused, noWait := bits[0], bits[1]
+
+	s := ch.c.s
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return &amqpError{code: replyAccessRefused, text: fmt.Sprintf("ACCESS_REFUSED - operation not permitted on exchange '%s'", name)}
+	}
+
+	if e, ok := s.exchanges[name]; ok {
+		if ifUnused && len(e.bindings) > 0 {
+			return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - exchange '%s' in vhost '/' in use", name)}
+		}
+		delete(s.exchanges, name)
+	}
+
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classExchange, 21))
+	}
+
+	return nil
+}
+
+// bindable returns the exchange, the default exchange can not be bound
+func (ch *channel) bindable(name string) (*exchange, *amqpError) {
+	if name == "" {
+		return nil, &amqpError{code: replyAccessRefused, text: "ACCESS_REFUSED - operation not permitted on the default exchange"}
+	}
+
+	e, ok := ch.c.s.exchanges[name]
+	if !ok {
+		return nil, &amqpError{code: replyNotFound, text: fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", name)}
+	}
+
+	return e, nil
+}
+
+//
+// Queue methods
+//
+
+func (ch *channel) queueDeclare(d *decoder) *amqpError {
+	d.short()
+	name := d.shortstr()
+	bits := d.bits(5)
+	passive, durable, exclusive, autoDelete, noWait := bits[0], bits[1], bits[2], bits[3], bits[4]
+	args := d.table()
+
+	s := ch.c.s
+	q, ok := s.queues[name]
+
+	switch {
+	case ok && q.exclusive && q.owner != ch.c:
+		return &amqpError{code: replyResourceLocked, text: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)}
+	case ok && !passive && !q.equivalent(durable, autoDelete, args):
+		return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s' in vhost '/'", name)}
+	case ok:
+		q.touch()
+	case passive:
+		return &amqpError{code: replyNotFound, text: fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name)}
+	case !validExpires(args):
+		return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - invalid arg 'x-expires' for queue '%s' in vhost '/': %v is not positive", name, args["x-expires"])}
+	case args["x-queue-type"] == "stream" && (!durable || exclusive || autoDelete):
+		return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - invalid property for stream queue '%s' in vhost '/', it must be durable, non-exclusive and not auto-delete", name)}
+	default:
+		q = s.declareQueue(name, ch.c, durable, exclusive, autoDelete, args)
+	}
+
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classQueue, 11).
+			shortstr(q.name).long(uint32(q.size())).long(uint32(len(q.consumers))))
+	}
+
+	return nil
+}
+
+func (ch *channel) queue(name string) (*queue, *amqpError) {
+	q, ok := ch.c.s.queues[name]
+	if !ok {
+		return nil, &amqpError{code: replyNotFound, text: fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name)}
+	}
+
+	if q.exclusive && q.owner != ch.c {
+		return nil, &amqpError{code: replyResourceLocked, text: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)}
+	}
+
+	return q, nil
+}
+
+func (ch *channel) queueBind(d *decoder) *amqpError {
+	d.short()
+	name, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+	noWait := d.bits(1)[0]
+	args := d.table()
+
+	q, err := ch.queue(name)
+	if err != nil {
+		return err
+	}
+
+	e, err := ch.bindable(exchange)
+	if err != nil {
+		return err
+	}
+
+	e.bind(q, key, args)
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classQueue, 21))
+	}
+
+	return nil
+}
+
+func (ch *channel) queueUnbind(d *decoder) *amqpError {
+	d.short()
+	name, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+	args := d.table()
+
+	q, err := ch.queue(name)
+	if err != nil {
+		return err
+	}
+
+	e, err := ch.bindable(exchange)
+	if err != nil {
+		return err
+	}
+
+	ch.c.s.unbind(e, func(b *binding) bool { return b.equal(q, key, args) })
+	ch.c.sendMethod(ch.id, newMethod(classQueue, 51))
+
+	return nil
+}
+
+func (ch *channel) queuePurge(d *decoder) *amqpError {
+	d.short()
+	name, noWait := d.shortstr(), d.bits(1)[0]
+
+	q, err := ch.queue(name)
+	if err != nil {
+		return err
+	}
+
+	n := q.purge()
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classQueue, 31).long(uint32(n)))
+	}
+
+	return nil
+}
+
+func (ch *channel) queueDelete(d *decoder) *amqpError {
+	d.short()
+	name, bits := d.shortstr(), d.bits(3)
+	ifUnused, ifEmpty, noWait := bits[0], bits[1], bits[2]
+
+	n := 0
+	if q, ok := ch.c.s.queues[name]; ok {
+		if q.exclusive && q.owner != ch.c {
+			return &amqpError{code: replyResourceLocked, text: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name)}
+		}
+		if ifUnused && len(q.consumers) > 0 {
+			return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name)}
+		}
+		if ifEmpty && len(q.ready) > 0 {
+			return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' is not empty", name)}
+		}
+		n = ch.c.s.deleteQueue(q)
+	}
+
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classQueue, 41).long(uint32(n)))
+	}
+
+	return nil
+}
+
+//
+// Basic methods
+//
+
+func (ch *channel) basicQos(d *decoder) *amqpError {
+	d.long()
+	count, global := int(d.short()), d.bits(1)[0]
+
+	if global {
+		ch.prefetchGlobal = count
+	} else {
+		ch.prefetch = count
+	}
+
+	ch.c.sendMethod(ch.id, newMethod(classBasic, 11))
+	ch.dispatch()
+
+	return nil
+}
+
+func (ch *channel) basicConsume(d *decoder) *amqpError {
+	d.short()
+	name, tag := d.shortstr(), d.shortstr()
+	bits := d.bits(4)
+	noAck, exclusive, noWait := bits[1], bits[2], bits[3]
+	args := d.table()
+
+	q, err := ch.queue(name)
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	if q.stream {
+		if noAck || ch.prefetch == 0 {
+			return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - consumer of stream queue '%s' in vhost '/' must set a prefetch count and ack manually", name)}
+		}
+
+		var ok bool
+		if offset, ok = q.streamOffset(args["x-stream-offset"]); !ok {
+			return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - invalid x-stream-offset %v", args["x-stream-offset"])}
+		}
+	}
+
+	if tag == "" {
+		tag = "amq.ctag-" + internal.RandomString(22)
+	}
+	if _, ok := ch.consumers[tag]; ok {
+		return &amqpError{code: replyNotAllowed, text: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", tag), hard: true}
+	}
+
+	for _, c := range q.consumers {
+		if c.exclusive || exclusive {
+			return &amqpError{code: replyAccessRefused, text: fmt.Sprintf("ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", name)}
+		}
+	}
+
+	c := &consumer{tag: tag, ch: ch, q: q, noAck: noAck, exclusive: exclusive, prefetch: ch.prefetch, offset: offset}
+	ch.consumers[tag] = c
+
+	// the deliveries must follow consume-ok
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classBasic, 21).shortstr(tag))
+	}
+
+	q.addConsumer(c)
+	q.dispatch()
+
+	return nil
+}
+
+func (ch *channel) basicCancel(d *decoder) *amqpError {
+	tag, noWait := d.shortstr(), d.bits(1)[0]
+
+	if c, ok := ch.consumers[tag]; ok {
+		delete(ch.consumers, tag)
+		c.q.removeConsumer(c)
+	}
+
+	if !noWait {
+		ch.c.sendMethod(ch.id, newMethod(classBasic, 31).shortstr(tag))
+	}
+
+	return nil
+}
+
+// cancel the consumer on behalf of the server, when its queue is deleted
+func (ch *channel) cancel(c *consumer) {
+	if ch.consumers[c.tag] != c {
+		return
+	}
+
+	delete(ch.consumers, c.tag)
+	ch.c.sendMethod(ch.id, newMethod(classBasic, 30).shortstr(c.tag).bits(true))
+}
+
+func (ch *channel) basicPublish(d *decoder) *amqpError {
+	d.short()
+	exchange, key := d.shortstr(), d.shortstr()
+	bits := d.bits(2)
+
+	if bits[1] {
+		return &amqpError{code: replyNotImplemented, text: "NOT_IMPLEMENTED - immediate=true", hard: true}
+	}
+
+	ch.publishing = &publishing{exchange: exchange, routingKey: key, mandatory: bits[0]}
+	return nil
+}
+
+// content receives the content header and body of the message being published
+func (ch *channel) content(f *frame) *amqpError {
+	p := ch.publishing
+	if p == nil {
+		return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - content without basic.publish", hard: true}
+	}
+
+	if f.typ == frameHeader {
+		if p.m != nil {
+			return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - expected content body", hard: true}
+		}
+
+		d := newDecoder(f.payload)
+		d.short()
+		d.short()
+		p.size = d.longlong()
+		props := d.properties()
+		if d.err != nil {
+			return &amqpError{code: replyFrameError, text: "FRAME_ERROR - " + d.err.Error(), hard: true}
+		}
+
+		p.m = &message{exchange: p.exchange, routingKey: p.routingKey, props: props}
+	} else {
+		if p.m == nil {
+			return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - expected content header", hard: true}
+		}
+		p.m.props.Body = append(p.m.props.Body, f.payload...)
+	}
+
+	if uint64(len(p.m.props.Body)) < p.size {
+		return nil
+	}
+
+	ch.publishing = nil
+	return ch.publish(p)
+}
+
+func (ch *channel) publish(p *publishing) *amqpError {
+	s := ch.c.s
+
+	e, ok := s.exchanges[p.exchange]
+	if ok && e.internal {
+		return &amqpError{code: replyAccessRefused, text: fmt.Sprintf("ACCESS_REFUSED - cannot publish to internal exchange '%s' in vhost '/'", p.exchange), class: classBasic, method: 40}
+	}
+
+	var delay time.Duration
+	var delayed bool
+	if ok {
+		delay, delayed = e.delay(p.m.props.Headers)
+	}
+
+	var queues []*queue
+	if delayed {
+		// the message is routed after the delay, so it has no route yet
+		s.delay(e, p.m, delay)
+	} else {
+		var err *amqpError
+		if queues, err = s.route(p.exchange, p.routingKey, p.m.props.Headers); err != nil {
+			err.class, err.method = classBasic, 40
+			return err
+		}
+	}
+
+	if len(queues) == 0 && p.mandatory {
+		ch.c.sendContent(ch.id, newMethod(classBasic, 50).
+			short(replyNoRoute).shortstr("NO_ROUTE").shortstr(p.exchange).shortstr(p.routingKey), p.m)
+	}
+
+	accepted := s.deliver(p.m, queues)
+
+	if ch.confirm {
+		ch.publishSeq++
+		if accepted {
+			ch.c.sendMethod(ch.id, newMethod(classBasic, 80).longlong(ch.publishSeq).bits(false))
+		} else {
+			ch.c.sendMethod(ch.id, newMethod(classBasic, 120).longlong(ch.publishSeq).bits(false, false))
+		}
+	}
+
+	return nil
+}
+
+func (ch *channel) basicGet(d *decoder) *amqpError {
+	d.short()
+	name, noAck := d.shortstr(), d.bits(1)[0]
+
+	q, err := ch.queue(name)
+	if err != nil {
+		return err
+	}
+
+	if q.stream {
+		return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - stream queue '%s' in vhost '/' does not support basic.get", name)}
+	}
+
+	m := q.get()
+	if m == nil {
+		ch.c.sendMethod(ch.id, newMethod(classBasic, 72).shortstr(""))
+		return nil
+	}
+
+	ch.nextTag++
+	if !noAck {
+		ch.unacked = append(ch.unacked, &delivery{tag: ch.nextTag, m: m, q: q})
+	}
+
+	ch.c.sendContent(ch.id, newMethod(classBasic, 71).
+		longlong(ch.nextTag).bits(m.redelivered).
+		shortstr(m.exchange).shortstr(m.routingKey).long(uint32(len(q.ready))), m)
+
+	return nil
+}
+
+//
+// Deliveries
+//
+
+// canDeliver reports whether the prefetch limits allow delivering to the consumer
+func (ch *channel) canDeliver(c *consumer) bool {
+	if ch.closing {
+		return false
+	}
+
+	if c.noAck {
+		return true
+	}
+
+	return (c.prefetch == 0 || c.unacked < c.prefetch) &&
+		(ch.prefetchGlobal == 0 || len(ch.unacked) < ch.prefetchGlobal)
+}
+
+func (ch *channel) deliver(c *consumer, m *message) {
+	ch.nextTag++
+	if !c.noAck {
+		ch.unacked = append(ch.unacked, &delivery{tag: ch.nextTag, m: m, q: c.q, c: c})
+		c.unacked++
+	}
+
+	ch.c.sendContent(ch.id, newMethod(classBasic, 60).
+		shortstr(c.tag).longlong(ch.nextTag).bits(m.redelivered).
+		shortstr(m.exchange).shortstr(m.routingKey), m)
+}
+
+// settle removes the deliveries up to the tag, or only the tag unless multiple
+func (ch *channel) settle(tag uint64, multiple bool, fn func(dl *delivery)) *amqpError {
+	var settled []*delivery
+	kept := ch.unacked[:0]
+	found := false
+
+	for _, dl := range ch.unacked {
+		switch {
+		case dl.tag == tag:
+			found = true
+			settled = append(settled, dl)
+		case multiple && (tag == 0 || dl.tag < tag):
+			settled = append(settled, dl)
+		default:
+			kept = append(kept, dl)
+		}
+	}
+
+	if !found && !(multiple && tag == 0) {
+		// restore the list, the channel is closed anyway
+		ch.unacked = append(kept, settled...)
+		return &amqpError{code: replyPreconditionFail, text: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)}
+	}
+	ch.unacked = kept
+
+	for _, dl := range settled {
+		if dl.c != nil {
+			dl.c.unacked--
+		}
+		fn(dl)
+	}
+
+	ch.dispatch()
+	for _, dl := range settled {
+		dl.q.dispatch()
+	}
+
+	return nil
+}
+
+func (ch *channel) nack(requeue bool) func(dl *delivery) {
+	return func(dl *delivery) {
+		if requeue {
+			dl.q.requeue(dl.m)
+		} else {
+			dl.q.deadLetter(dl.m, "rejected")
+		}
+	}
+}
+
+// recover requeues all unacked messages
+func (ch *channel) recover() {
+	unacked := ch.unacked
+	ch.unacked = nil
+
+	for _, dl := range unacked {
+		if dl.c != nil {
+			dl.c.unacked--
+		}
+		dl.q.requeue(dl.m)
+	}
+
+	for _, dl := range unacked {
+		dl.q.dispatch()
+	}
+}
+
+// dispatch the queues consumed on the channel, after its capacity has changed
+func (ch *channel) dispatch() {
+	for _, c := range ch.consumers {
+		c.q.dispatch()
+	}
+}
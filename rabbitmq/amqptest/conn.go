@@ -0,0 +1,419 @@
+package amqptest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	classConnection = 10
+	classChannel    = 20
+	classExchange   = 40
+	classQueue      = 50
+	classBasic      = 60
+	classConfirm    = 85
+	classTx         = 90
+)
+
+const (
+	replySuccess          = 200
+	replyConnectionForced = 320
+	replyNoRoute          = 312
+	replyAccessRefused    = 403
+	replyNotFound         = 404
+	replyResourceLocked   = 405
+	replyPreconditionFail = 406
+	replyFrameError       = 501
+	replyUnexpectedFrame  = 505
+	replyCommandInvalid   = 503
+	replyChannelError     = 504
+	replyNotAllowed       = 530
+	replyNotImplemented   = 540
+)
+
+const defaultFrameMax = 131072
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// amqpError closes the channel, or the connection if it is hard
+type amqpError struct {
+	code   uint16
+	text   string
+	class  uint16
+	method uint16
+	hard   bool
+}
+
+type conn struct {
+	s  *Server
+	nc net.Conn
+	r  *bufio.Reader
+
+	// the fields below are guarded by the server lock
+	frameMax  uint32
+	heartbeat time.Duration
+	channels  map[uint16]*channel
+	dead      bool
+	// the handshake of the client, reported once the connection is open
+	client Client
+	opened bool
+
+	// outgoing frames, written by the writer goroutine
+	outMu   sync.Mutex
+	outCond *sync.Cond
+	out     [][]byte
+	// the socket is closed when everything is written
+	closing bool
+	done    chan struct{}
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	c := &conn{
+		s:        s,
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		frameMax: defaultFrameMax,
+		channels: make(map[uint16]*channel),
+		done:     make(chan struct{}),
+	}
+	c.outCond = sync.NewCond(&c.outMu)
+
+	return c
+}
+
+func (c *conn) serve() {
+	go c.write()
+
+	defer func() {
+		c.s.mu.Lock()
+		c.cleanup()
+		c.s.mu.Unlock()
+
+		c.shutdown()
+	}()
+
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	if !bytes.Equal(header, protocolHeader) {
+		// tell the client which protocol is supported
+		c.send(protocolHeader)
+		return
+	}
+
+	c.sendMethod(0, newMethod(classConnection, 10).
+		octet(0).octet(9).
+		table(serverProperties()).
+		longstr(c.s.mechanisms()).
+		longstr("en_US"))
+
+	for {
+		f, err := readFrame(c.r)
+		if err != nil {
+			if err == errMalformed {
+				c.s.mu.Lock()
+				c.fail(&amqpError{code: replyFrameError, text: "FRAME_ERROR - malformed frame", hard: true})
+				c.s.mu.Unlock()
+			}
+			return
+		}
+
+		c.s.mu.Lock()
+		if !c.dead {
+			c.handle(f)
+		}
+		dead := c.dead
+		c.s.mu.Unlock()
+
+		if dead {
+			return
+		}
+	}
+}
+
+func serverProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"product": "amqptest",
+		"version": "0.9.1",
+		"capabilities": map[string]interface{}{
+			"publisher_confirms":         true,
+			"basic.nack":                 true,
+			"consumer_cancel_notify":     true,
+			"per_consumer_qos":           true,
+			"connection.blocked":         true,
+			"exchange_exchange_bindings": false,
+		},
+	}
+}
+
+// handle a frame from the client, the caller must hold the server lock
+func (c *conn) handle(f *frame) {
+	if f.typ == frameHeartbeat {
+		return
+	}
+
+	if f.channel == 0 {
+		if f.typ != frameMethod {
+			c.fail(&amqpError{code: replyCommandInvalid, text: "COMMAND_INVALID - content on channel 0", hard: true})
+			return
+		}
+
+		d := newDecoder(f.payload)
+		class, method := d.short(), d.short()
+		if err := c.handleConnection(class, method, d); err != nil {
+			c.fail(err)
+		}
+		return
+	}
+
+	ch := c.channels[f.channel]
+	if ch == nil {
+		c.openChannel(f)
+		return
+	}
+
+	if ch.closing {
+		// everything but close-ok is discarded until the client confirms the close
+		if f.typ == frameMethod {
+			d := newDecoder(f.payload)
+			if class, method := d.short(), d.short(); class == classChannel && (method == 40 || method == 41) {
+				if method == 40 {
+					c.sendMethod(ch.id, newMethod(classChannel, 41))
+				}
+				delete(c.channels, ch.id)
+			}
+		}
+		return
+	}
+
+	var err *amqpError
+	switch f.typ {
+	case frameMethod:
+		d := newDecoder(f.payload)
+		class, method := d.short(), d.short()
+		err = ch.handle(class, method, d)
+		if err != nil && err.class == 0 {
+			err.class, err.method = class, method
+		}
+	case frameHeader, frameBody:
+		err = ch.content(f)
+	default:
+		err = &amqpError{code: replyFrameError, text: "FRAME_ERROR - unknown frame type", hard: true}
+	}
+
+	if err == nil {
+		return
+	}
+
+	if err.hard {
+		c.fail(err)
+	} else {
+		ch.fail(err)
+	}
+}
+
+func (c *conn) handleConnection(class, method uint16, d *decoder) *amqpError {
+	if class != classConnection {
+		return &amqpError{code: replyCommandInvalid, text: "COMMAND_INVALID - unexpected method on channel 0", class: class, method: method, hard: true}
+	}
+
+	switch method {
+	case 11: // start-ok, any credentials are accepted
+		c.client.Properties = d.table()
+		c.client.Mechanism = d.shortstr()
+		if !c.authenticate(c.client.Mechanism) {
+			return &amqpError{code: replyAccessRefused, text: "ACCESS_REFUSED - login refused using authentication mechanism " + c.client.Mechanism, class: class, method: method, hard: true}
+		}
+		c.sendMethod(0, newMethod(classConnection, 30).
+			short(0).long(defaultFrameMax).short(0))
+	case 31: // tune-ok
+		d.short()
+		c.frameMax = d.long()
+		c.heartbeat = time.Duration(d.short()) * time.Second
+		c.client.FrameMax, c.client.Heartbeat = int(c.frameMax), c.heartbeat
+		if c.heartbeat > 0 {
+			go c.heartbeater(c.heartbeat)
+		}
+	case 40: // open
+		c.client.Vhost = d.shortstr()
+		c.opened = true
+		c.sendMethod(0, newMethod(classConnection, 41).shortstr(""))
+	case 50: // close
+		c.cleanup()
+		c.sendMethod(0, newMethod(classConnection, 51))
+		c.shutdown()
+	case 51: // close-ok
+		c.cleanup()
+		c.shutdown()
+	default:
+		return &amqpError{code: replyNotImplemented, text: "NOT_IMPLEMENTED", class: class, method: method, hard: true}
+	}
+
+	if d.err != nil {
+		return &amqpError{code: replyFrameError, text: "FRAME_ERROR - " + d.err.Error(), class: class, method: method, hard: true}
+	}
+
+	return nil
+}
+
+// authenticate accepts the offered mechanisms, EXTERNAL requires a client certificate
+func (c *conn) authenticate(mechanism string) bool {
+	if !strings.Contains(" "+c.s.mechanisms()+" ", " "+mechanism+" ") {
+		return false
+	}
+
+	if mechanism != "EXTERNAL" {
+		return true
+	}
+
+	tc, ok := c.nc.(*tls.Conn)
+	return ok && len(tc.ConnectionState().PeerCertificates) > 0
+}
+
+func (c *conn) openChannel(f *frame) {
+	if f.typ == frameMethod {
+		d := newDecoder(f.payload)
+		if class, method := d.short(), d.short(); class == classChannel && method == 10 {
+			c.channels[f.channel] = newChannel(c, f.channel)
+			c.sendMethod(f.channel, newMethod(classChannel, 11).longstr(""))
+			return
+		}
+	}
+
+	c.fail(&amqpError{code: replyChannelError, text: "CHANNEL_ERROR - expected 'channel.open'", hard: true})
+}
+
+// fail closes the connection with the error, the caller must hold the server lock
+func (c *conn) fail(err *amqpError) {
+	if c.dead {
+		return
+	}
+
+	c.cleanup()
+	c.sendMethod(0, newMethod(classConnection, 50).
+		short(err.code).shortstr(err.text).short(err.class).short(err.method))
+	c.shutdown()
+}
+
+// cleanup releases the channels and exclusive queues of the connection,
+// the caller must hold the server lock
+func (c *conn) cleanup() {
+	if c.dead {
+		return
+	}
+	c.dead = true
+
+	for _, ch := range c.channels {
+		ch.cleanup()
+	}
+	c.channels = map[uint16]*channel{}
+
+	for _, q := range c.s.queues {
+		if q.owner == c {
+			c.s.deleteQueue(q)
+		}
+	}
+
+	delete(c.s.conns, c)
+}
+
+//
+// Writing
+//
+
+func (c *conn) sendMethod(channel uint16, method *encoder) {
+	c.send((&frame{typ: frameMethod, channel: channel, payload: method.Bytes()}).bytes())
+}
+
+// sendContent sends the method followed by the content of the message,
+// the frames are queued together so that they are not interleaved with others
+func (c *conn) sendContent(channel uint16, method *encoder, m *message) {
+	frames := [][]byte{
+		(&frame{typ: frameMethod, channel: channel, payload: method.Bytes()}).bytes(),
+		(&frame{typ: frameHeader, channel: channel, payload: header(&m.props)}).bytes(),
+	}
+
+	size := len(m.props.Body)
+	if c.frameMax > 8 {
+		size = int(c.frameMax) - 8
+	}
+
+	for body := m.props.Body; len(body) > 0; {
+		n := size
+		if n > len(body) {
+			n = len(body)
+		}
+		frames = append(frames, (&frame{typ: frameBody, channel: channel, payload: body[:n]}).bytes())
+		body = body[n:]
+	}
+
+	c.send(frames...)
+}
+
+func (c *conn) send(frames ...[]byte) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if c.closing {
+		return
+	}
+
+	c.out = append(c.out, frames...)
+	c.outCond.Signal()
+}
+
+// shutdown closes the socket after the queued frames are written
+func (c *conn) shutdown() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	c.closing = true
+	c.outCond.Signal()
+}
+
+func (c *conn) write() {
+	defer close(c.done)
+	defer c.nc.Close()
+
+	for {
+		c.outMu.Lock()
+		for len(c.out) == 0 && !c.closing {
+			c.outCond.Wait()
+		}
+		out, closing := c.out, c.closing
+		c.out = nil
+		c.outMu.Unlock()
+
+		for _, b := range out {
+			if _, err := c.nc.Write(b); err != nil {
+				return
+			}
+		}
+
+		if closing && len(out) == 0 {
+			return
+		}
+	}
+}
+
+func (c *conn) heartbeater(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	heartbeat := (&frame{typ: frameHeartbeat}).bytes()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.send(heartbeat)
+		}
+	}
+}
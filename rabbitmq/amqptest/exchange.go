@@ -0,0 +1,202 @@
+package amqptest
+
+import (
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	kindDirect  = "direct"
+	kindFanout  = "fanout"
+	kindTopic   = "topic"
+	kindHeaders = "headers"
+	// kindDelayed is the exchange of the delayed message plugin, messages are routed
+	// by the x-delayed-type exchange type after the delay in their x-delay header
+	kindDelayed = "x-delayed-message"
+)
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+
+	bindings []*binding
+}
+
+type binding struct {
+	q    *queue
+	key  string
+	args amqp.Table
+}
+
+func (b *binding) equal(q *queue, key string, args amqp.Table) bool {
+	if b.q != q || b.key != key || len(b.args) != len(args) {
+		return false
+	}
+
+	for k, v := range b.args {
+		if !equalField(v, args[k]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validKind(kind string) bool {
+	switch kind {
+	case kindDirect, kindFanout, kindTopic, kindHeaders, kindDelayed:
+		return true
+	}
+
+	return false
+}
+
+// validDelayedType reports whether the x-delayed-type of a delayed exchange is a routing type
+func validDelayedType(v interface{}) bool {
+	kind, ok := v.(string)
+	return ok && kind != kindDelayed && validKind(kind)
+}
+
+func (e *exchange) equivalent(kind string, durable, autoDelete, internal bool, args amqp.Table) bool {
+	if e.kind != kind || e.durable != durable || e.autoDelete != autoDelete || e.internal != internal || len(e.args) != len(args) {
+		return false
+	}
+
+	for k, v := range e.args {
+		if !equalField(v, args[k]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *exchange) bind(q *queue, key string, args amqp.Table) {
+	for _, b := range e.bindings {
+		if b.equal(q, key, args) {
+			return
+		}
+	}
+
+	e.bindings = append(e.bindings, &binding{q: q, key: key, args: args})
+}
+
+// unbind removes the bindings matching fn, it reports whether any is removed
+func (e *exchange) unbind(fn func(b *binding) bool) bool {
+	bindings := e.bindings[:0]
+	for _, b := range e.bindings {
+		if !fn(b) {
+			bindings = append(bindings, b)
+		}
+	}
+
+	removed := len(bindings) != len(e.bindings)
+	for i := len(bindings); i < len(e.bindings); i++ {
+		e.bindings[i] = nil
+	}
+	e.bindings = bindings
+
+	return removed
+}
+
+// route returns the queues bound to the exchange which match the message, without duplicates
+func (e *exchange) route(key string, headers amqp.Table) []*queue {
+	var queues []*queue
+	seen := make(map[*queue]bool)
+
+	for _, b := range e.bindings {
+		if seen[b.q] || !e.match(b, key, headers) {
+			continue
+		}
+
+		seen[b.q] = true
+		queues = append(queues, b.q)
+	}
+
+	return queues
+}
+
+// delay returns the x-delay of a message published to a delayed exchange
+func (e *exchange) delay(headers amqp.Table) (time.Duration, bool) {
+	if e.kind != kindDelayed {
+		return 0, false
+	}
+
+	v, ok := integer(headers["x-delay"])
+	if !ok || v <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(v) * time.Millisecond, true
+}
+
+func (e *exchange) match(b *binding, key string, headers amqp.Table) bool {
+	kind := e.kind
+	if kind == kindDelayed {
+		kind, _ = e.args["x-delayed-type"].(string)
+	}
+
+	switch kind {
+	case kindFanout:
+		return true
+	case kindTopic:
+		return matchTopic(strings.Split(b.key, "."), strings.Split(key, "."))
+	case kindHeaders:
+		return matchHeaders(b.args, headers)
+	}
+
+	return b.key == key
+}
+
+// matchTopic matches the words of a routing key against a binding pattern,
+// "*" matches exactly one word and "#" matches zero or more words
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	}
+
+	return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+}
+
+// matchHeaders matches the headers of a message against the binding arguments,
+// x-match is "all" (the default) or "any", other arguments prefixed by "x-" are ignored
+func matchHeaders(args, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+
+		h, ok := headers[k]
+		// an argument without value only requires the header to be present
+		ok = ok && (v == nil || equalField(v, h))
+
+		if ok && matchAny {
+			return true
+		}
+		if !ok && !matchAny {
+			return false
+		}
+	}
+
+	return !matchAny
+}
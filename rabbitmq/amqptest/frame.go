@@ -0,0 +1,449 @@
+package amqptest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 206
+)
+
+// property flags of the content header
+const (
+	flagContentType     = 0x8000
+	flagContentEncoding = 0x4000
+	flagHeaders         = 0x2000
+	flagDeliveryMode    = 0x1000
+	flagPriority        = 0x0800
+	flagCorrelationID   = 0x0400
+	flagReplyTo         = 0x0200
+	flagExpiration      = 0x0100
+	flagMessageID       = 0x0080
+	flagTimestamp       = 0x0040
+	flagType            = 0x0020
+	flagUserID          = 0x0010
+	flagAppID           = 0x0008
+)
+
+var errMalformed = errors.New("amqptest: malformed frame")
+
+type frame struct {
+	typ     uint8
+	channel uint16
+	payload []byte
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		typ:     header[0],
+		channel: binary.BigEndian.Uint16(header[1:3]),
+		payload: make([]byte, binary.BigEndian.Uint32(header[3:7])),
+	}
+
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+
+	end, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if end != frameEnd {
+		return nil, errMalformed
+	}
+
+	return f, nil
+}
+
+func (f *frame) bytes() []byte {
+	b := make([]byte, 7, 8+len(f.payload))
+	b[0] = f.typ
+	binary.BigEndian.PutUint16(b[1:3], f.channel)
+	binary.BigEndian.PutUint32(b[3:7], uint32(len(f.payload)))
+	b = append(b, f.payload...)
+	return append(b, frameEnd)
+}
+
+//
+// Decoding
+//
+
+// decoder reads the fields of a frame payload, the first error is kept in err
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newDecoder(payload []byte) *decoder {
+	return &decoder{r: bytes.NewReader(payload)}
+}
+
+func (d *decoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.BigEndian, v)
+	}
+}
+
+func (d *decoder) octet() (v uint8) {
+	d.read(&v)
+	return
+}
+
+func (d *decoder) short() (v uint16) {
+	d.read(&v)
+	return
+}
+
+func (d *decoder) long() (v uint32) {
+	d.read(&v)
+	return
+}
+
+func (d *decoder) longlong() (v uint64) {
+	d.read(&v)
+	return
+}
+
+// bits reads n packed bits
+func (d *decoder) bits(n int) []bool {
+	octet := d.octet()
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = octet&(1<<uint(i)) != 0
+	}
+
+	return bits
+}
+
+func (d *decoder) bytes(n int) []byte {
+	b := make([]byte, n)
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+	}
+
+	return b
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.bytes(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.bytes(int(d.long())))
+}
+
+func (d *decoder) table() amqp.Table {
+	data := d.bytes(int(d.long()))
+	if d.err != nil {
+		return nil
+	}
+
+	nested := newDecoder(data)
+	table := amqp.Table{}
+	for nested.err == nil && nested.r.Len() > 0 {
+		key := nested.shortstr()
+		table[key] = nested.field()
+	}
+
+	if nested.err != nil {
+		d.err = nested.err
+	}
+
+	return table
+}
+
+func (d *decoder) field() interface{} {
+	switch typ := d.octet(); typ {
+	case 't':
+		return d.octet() != 0
+	case 'b':
+		return d.octet()
+	case 's':
+		return int16(d.short())
+	case 'I':
+		return int32(d.long())
+	case 'l':
+		return int64(d.longlong())
+	case 'f':
+		return math.Float32frombits(d.long())
+	case 'd':
+		return math.Float64frombits(d.longlong())
+	case 'D':
+		scale := d.octet()
+		return amqp.Decimal{Scale: scale, Value: int32(d.long())}
+	case 'S':
+		return d.longstr()
+	case 'A':
+		data := d.bytes(int(d.long()))
+		nested := newDecoder(data)
+		array := []interface{}{}
+		for nested.err == nil && nested.r.Len() > 0 {
+			array = append(array, nested.field())
+		}
+		if nested.err != nil {
+			d.err = nested.err
+		}
+		return array
+	case 'T':
+		return time.Unix(int64(d.longlong()), 0)
+	case 'F':
+		return d.table()
+	case 'x':
+		return d.bytes(int(d.long()))
+	case 'V':
+		return nil
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("amqptest: unknown field type %q", typ)
+		}
+		return nil
+	}
+}
+
+// properties reads the properties of a content header
+func (d *decoder) properties() amqp.Publishing {
+	var p amqp.Publishing
+
+	flags := d.short()
+	if flags&flagContentType != 0 {
+		p.ContentType = d.shortstr()
+	}
+	if flags&flagContentEncoding != 0 {
+		p.ContentEncoding = d.shortstr()
+	}
+	if flags&flagHeaders != 0 {
+		p.Headers = d.table()
+	}
+	if flags&flagDeliveryMode != 0 {
+		p.DeliveryMode = d.octet()
+	}
+	if flags&flagPriority != 0 {
+		p.Priority = d.octet()
+	}
+	if flags&flagCorrelationID != 0 {
+		p.CorrelationId = d.shortstr()
+	}
+	if flags&flagReplyTo != 0 {
+		p.ReplyTo = d.shortstr()
+	}
+	if flags&flagExpiration != 0 {
+		p.Expiration = d.shortstr()
+	}
+	if flags&flagMessageID != 0 {
+		p.MessageId = d.shortstr()
+	}
+	if flags&flagTimestamp != 0 {
+		p.Timestamp = time.Unix(int64(d.longlong()), 0)
+	}
+	if flags&flagType != 0 {
+		p.Type = d.shortstr()
+	}
+	if flags&flagUserID != 0 {
+		p.UserId = d.shortstr()
+	}
+	if flags&flagAppID != 0 {
+		p.AppId = d.shortstr()
+	}
+
+	return p
+}
+
+//
+// Encoding
+//
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func newMethod(class, method uint16) *encoder {
+	e := &encoder{}
+	e.short(class)
+	e.short(method)
+	return e
+}
+
+func (e *encoder) octet(v uint8) *encoder {
+	e.WriteByte(v)
+	return e
+}
+
+func (e *encoder) short(v uint16) *encoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *encoder) long(v uint32) *encoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+func (e *encoder) longlong(v uint64) *encoder {
+	binary.Write(e, binary.BigEndian, v)
+	return e
+}
+
+// bits writes the values as packed bits
+func (e *encoder) bits(values ...bool) *encoder {
+	var octet uint8
+	for i, v := range values {
+		if v {
+			octet |= 1 << uint(i)
+		}
+	}
+
+	return e.octet(octet)
+}
+
+func (e *encoder) shortstr(v string) *encoder {
+	e.octet(uint8(len(v)))
+	e.WriteString(v)
+	return e
+}
+
+func (e *encoder) longstr(v string) *encoder {
+	e.long(uint32(len(v)))
+	e.WriteString(v)
+	return e
+}
+
+func (e *encoder) table(t amqp.Table) *encoder {
+	nested := &encoder{}
+	for k, v := range t {
+		nested.shortstr(k)
+		nested.field(v)
+	}
+
+	e.long(uint32(nested.Len()))
+	e.Write(nested.Bytes())
+	return e
+}
+
+func (e *encoder) field(value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		e.octet('t').bits(v)
+	case byte:
+		e.octet('b').octet(v)
+	case int16:
+		e.octet('s').short(uint16(v))
+	case int:
+		e.octet('I').long(uint32(v))
+	case int32:
+		e.octet('I').long(uint32(v))
+	case int64:
+		e.octet('l').longlong(uint64(v))
+	case float32:
+		e.octet('f').long(math.Float32bits(v))
+	case float64:
+		e.octet('d').longlong(math.Float64bits(v))
+	case amqp.Decimal:
+		e.octet('D').octet(v.Scale).long(uint32(v.Value))
+	case string:
+		e.octet('S').longstr(v)
+	case []interface{}:
+		nested := &encoder{}
+		for _, item := range v {
+			nested.field(item)
+		}
+		e.octet('A').long(uint32(nested.Len()))
+		e.Write(nested.Bytes())
+	case time.Time:
+		e.octet('T').longlong(uint64(v.Unix()))
+	case amqp.Table:
+		e.octet('F').table(v)
+	case map[string]interface{}:
+		e.octet('F').table(amqp.Table(v))
+	case []byte:
+		e.octet('x').long(uint32(len(v)))
+		e.Write(v)
+	default:
+		e.octet('V')
+	}
+}
+
+// header returns the content header payload of the message
+func header(p *amqp.Publishing) []byte {
+	var flags uint16
+	props := &encoder{}
+
+	if p.ContentType != "" {
+		flags |= flagContentType
+		props.shortstr(p.ContentType)
+	}
+	if p.ContentEncoding != "" {
+		flags |= flagContentEncoding
+		props.shortstr(p.ContentEncoding)
+	}
+	if len(p.Headers) > 0 {
+		flags |= flagHeaders
+		props.table(p.Headers)
+	}
+	if p.DeliveryMode > 0 {
+		flags |= flagDeliveryMode
+		props.octet(p.DeliveryMode)
+	}
+	if p.Priority > 0 {
+		flags |= flagPriority
+		props.octet(p.Priority)
+	}
+	if p.CorrelationId != "" {
+		flags |= flagCorrelationID
+		props.shortstr(p.CorrelationId)
+	}
+	if p.ReplyTo != "" {
+		flags |= flagReplyTo
+		props.shortstr(p.ReplyTo)
+	}
+	if p.Expiration != "" {
+		flags |= flagExpiration
+		props.shortstr(p.Expiration)
+	}
+	if p.MessageId != "" {
+		flags |= flagMessageID
+		props.shortstr(p.MessageId)
+	}
+	if !p.Timestamp.IsZero() {
+		flags |= flagTimestamp
+		props.longlong(uint64(p.Timestamp.Unix()))
+	}
+	if p.Type != "" {
+		flags |= flagType
+		props.shortstr(p.Type)
+	}
+	if p.UserId != "" {
+		flags |= flagUserID
+		props.shortstr(p.UserId)
+	}
+	if p.AppId != "" {
+		flags |= flagAppID
+		props.shortstr(p.AppId)
+	}
+
+	e := &encoder{}
+	e.short(classBasic)
+	e.short(0)
+	e.longlong(uint64(len(p.Body)))
+	e.short(flags)
+	e.Write(props.Bytes())
+
+	return e.Bytes()
+}
@@ -0,0 +1,578 @@
+package amqptest
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type message struct {
+	seq         uint64
+	exchange    string
+	routingKey  string
+	props       amqp.Publishing
+	redelivered bool
+	// expires is zero if the message never expires
+	expires time.Time
+	// timestamp is when the message is appended to a stream
+	timestamp time.Time
+}
+
+func (m *message) clone() *message {
+	c := *m
+	if m.props.Headers != nil {
+		c.props.Headers = make(amqp.Table, len(m.props.Headers))
+		for k, v := range m.props.Headers {
+			c.props.Headers[k] = v
+		}
+	}
+
+	return &c
+}
+
+type consumer struct {
+	tag       string
+	ch        *channel
+	q         *queue
+	noAck     bool
+	exclusive bool
+	// maximum number of unacked messages, 0 is unlimited
+	prefetch int
+	unacked  int
+	// offset is the next message of a stream to deliver
+	offset int
+}
+
+// queue holds the ready messages in delivery order, all methods must be called with
+// the server lock held
+type queue struct {
+	s          *Server
+	name       string
+	durable    bool
+	exclusive  bool
+	autoDelete bool
+	args       amqp.Table
+	// the connection which declared the exclusive queue
+	owner *conn
+
+	ttl         time.Duration
+	hasTTL      bool
+	expires     time.Duration
+	maxPriority uint8
+	dlx         string
+	hasDLX      bool
+	dlk         string
+	hasDLK      bool
+	// x-max-length and x-max-length-bytes limit the ready messages, 0 is unlimited
+	maxLength      int
+	maxLengthBytes int
+	overflow       string
+	singleActive   bool
+	// stream queues append the messages to a log which consumers read from an offset
+	stream bool
+	log    []*message
+
+	ready     []*message
+	consumers []*consumer
+	next      int
+
+	ttlTimer    *time.Timer
+	expiryTimer *time.Timer
+	deleted     bool
+}
+
+// validExpires reports whether x-expires is unset or positive, the broker rejects other values
+func validExpires(args amqp.Table) bool {
+	v, ok := integer(args["x-expires"])
+	return !ok || v > 0
+}
+
+func newQueue(s *Server, name string, durable, exclusive, autoDelete bool, args amqp.Table) *queue {
+	q := &queue{
+		s:          s,
+		name:       name,
+		durable:    durable,
+		exclusive:  exclusive,
+		autoDelete: autoDelete,
+		args:       args,
+	}
+
+	if v, ok := integer(args["x-message-ttl"]); ok && v >= 0 {
+		q.ttl, q.hasTTL = time.Duration(v)*time.Millisecond, true
+	}
+	if v, ok := integer(args["x-expires"]); ok && v > 0 {
+		q.expires = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := integer(args["x-max-priority"]); ok && v > 0 {
+		if v > 255 {
+			v = 255
+		}
+		q.maxPriority = uint8(v)
+	}
+	if v, ok := args["x-dead-letter-exchange"].(string); ok {
+		q.dlx, q.hasDLX = v, true
+	}
+	if v, ok := args["x-dead-letter-routing-key"].(string); ok {
+		q.dlk, q.hasDLK = v, true
+	}
+	if v, ok := integer(args["x-max-length"]); ok && v >= 0 {
+		q.maxLength = int(v)
+		if v == 0 {
+			// no message can be kept
+			q.maxLength = -1
+		}
+	}
+	if v, ok := integer(args["x-max-length-bytes"]); ok && v > 0 {
+		q.maxLengthBytes = int(v)
+	}
+	q.overflow, _ = args["x-overflow"].(string)
+	q.singleActive, _ = args["x-single-active-consumer"].(bool)
+	q.stream = args["x-queue-type"] == "stream"
+
+	return q
+}
+
+// size returns the number of ready messages, or of messages in the log of a stream
+func (q *queue) size() int {
+	if q.stream {
+		return len(q.log)
+	}
+
+	return len(q.ready)
+}
+
+// equivalent reports whether redeclaring the queue with the values is allowed
+func (q *queue) equivalent(durable, autoDelete bool, args amqp.Table) bool {
+	if q.durable != durable || q.autoDelete != autoDelete || len(q.args) != len(args) {
+		return false
+	}
+
+	for k, v := range q.args {
+		if !equalField(v, args[k]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (q *queue) priority(m *message) uint8 {
+	if m.props.Priority > q.maxPriority {
+		return q.maxPriority
+	}
+
+	return m.props.Priority
+}
+
+// insert the message keeping the delivery order, which is priority and then publishing order
+func (q *queue) insert(m *message) {
+	p := q.priority(m)
+	i := sort.Search(len(q.ready), func(i int) bool {
+		pi := q.priority(q.ready[i])
+		return pi < p || (pi == p && q.ready[i].seq > m.seq)
+	})
+
+	q.ready = append(q.ready, nil)
+	copy(q.ready[i+1:], q.ready[i:])
+	q.ready[i] = m
+}
+
+// overflowed reports whether the ready messages exceed x-max-length or x-max-length-bytes
+// if extra more messages of size bytes are added
+func (q *queue) overflowed(extra, size int) bool {
+	if q.maxLength == -1 {
+		return len(q.ready)+extra > 0
+	}
+	if q.maxLength > 0 && len(q.ready)+extra > q.maxLength {
+		return true
+	}
+	if q.maxLengthBytes <= 0 {
+		return false
+	}
+
+	for _, m := range q.ready {
+		size += len(m.props.Body)
+	}
+	return size > q.maxLengthBytes
+}
+
+// enqueue the message, it returns false if the message is rejected by x-overflow
+func (q *queue) enqueue(m *message) bool {
+	if q.deleted {
+		return true
+	}
+
+	if q.stream {
+		m.timestamp = time.Now()
+		q.log = append(q.log, m)
+		q.dispatch()
+		return true
+	}
+
+	if q.overflow == "reject-publish" || q.overflow == "reject-publish-dlx" {
+		if q.overflowed(1, len(m.props.Body)) {
+			if q.overflow == "reject-publish-dlx" {
+				q.deadLetter(m, "maxlen")
+			}
+			return false
+		}
+	}
+
+	ttl, ok := q.ttl, q.hasTTL
+	if v, err := strconv.ParseInt(m.props.Expiration, 10, 64); err == nil && v >= 0 {
+		if d := time.Duration(v) * time.Millisecond; !ok || d < ttl {
+			ttl, ok = d, true
+		}
+	}
+	if ok {
+		m.expires = time.Now().Add(ttl)
+	}
+
+	q.insert(m)
+	q.dispatch()
+
+	// drop-head, the default overflow behaviour
+	for len(q.ready) > 0 && q.overflowed(0, 0) {
+		head := q.ready[0]
+		q.ready = q.ready[1:]
+		q.deadLetter(head, "maxlen")
+	}
+
+	q.expire()
+	return true
+}
+
+// requeue puts back the message which has been delivered to its original position
+func (q *queue) requeue(m *message) {
+	// messages stay in the log of a stream whether they are acked or not
+	if q.deleted || q.stream {
+		return
+	}
+
+	m.redelivered = true
+	q.insert(m)
+}
+
+// dispatch delivers the ready messages to the consumers which have capacity, in turns
+func (q *queue) dispatch() {
+	if q.stream {
+		q.dispatchStream()
+		return
+	}
+
+	for len(q.ready) > 0 {
+		m := q.ready[0]
+		if !m.expires.IsZero() && !m.expires.After(time.Now()) {
+			q.ready = q.ready[1:]
+			q.deadLetter(m, "expired")
+			continue
+		}
+
+		c := q.available()
+		if c == nil {
+			return
+		}
+
+		q.ready = q.ready[1:]
+		c.ch.deliver(c, m)
+	}
+}
+
+// dispatchStream delivers the messages of the log to each consumer from its offset,
+// with their offset in the x-stream-offset header
+func (q *queue) dispatchStream() {
+	for _, c := range q.consumers {
+		for c.offset < len(q.log) && c.ch.canDeliver(c) {
+			m := q.log[c.offset].clone()
+			if m.props.Headers == nil {
+				m.props.Headers = amqp.Table{}
+			}
+			m.props.Headers["x-stream-offset"] = int64(c.offset)
+
+			c.offset++
+			c.ch.deliver(c, m)
+		}
+	}
+}
+
+// streamOffset returns the position in the log of the x-stream-offset consumer argument,
+// which is first, last, next (the default), an offset or a timestamp
+func (q *queue) streamOffset(v interface{}) (int, bool) {
+	switch offset := v.(type) {
+	case nil:
+		return len(q.log), true
+	case string:
+		switch offset {
+		case "first":
+			return 0, true
+		case "last":
+			// the log has a single chunk per message
+			if len(q.log) > 0 {
+				return len(q.log) - 1, true
+			}
+			return 0, true
+		case "next":
+			return len(q.log), true
+		}
+	case time.Time:
+		i := sort.Search(len(q.log), func(i int) bool {
+			return q.log[i].timestamp.Unix() >= offset.Unix()
+		})
+		return i, true
+	}
+
+	if i, ok := integer(v); ok && i >= 0 {
+		if i > int64(len(q.log)) {
+			i = int64(len(q.log))
+		}
+		return int(i), true
+	}
+
+	return 0, false
+}
+
+func (q *queue) available() *consumer {
+	if q.singleActive {
+		// the first consumer is the active one until it is cancelled
+		if len(q.consumers) > 0 && q.consumers[0].ch.canDeliver(q.consumers[0]) {
+			return q.consumers[0]
+		}
+		return nil
+	}
+
+	for i := 0; i < len(q.consumers); i++ {
+		n := (q.next + i) % len(q.consumers)
+		if c := q.consumers[n]; c.ch.canDeliver(c) {
+			q.next = n + 1
+			return c
+		}
+	}
+
+	return nil
+}
+
+// get takes the first ready message, it returns nil if there is none
+func (q *queue) get() *message {
+	q.touch()
+	q.expire()
+
+	if len(q.ready) == 0 {
+		return nil
+	}
+
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	return m
+}
+
+func (q *queue) purge() int {
+	n := len(q.ready)
+	q.ready = nil
+	q.expire()
+
+	return n
+}
+
+// expire dead-letters the expired messages,
+// and schedules the next expiration
+func (q *queue) expire() {
+	if q.ttlTimer != nil {
+		q.ttlTimer.Stop()
+		q.ttlTimer = nil
+	}
+
+	now := time.Now()
+	var next time.Time
+
+	ready := q.ready[:0]
+	var expired []*message
+	for _, m := range q.ready {
+		switch {
+		case m.expires.IsZero():
+			ready = append(ready, m)
+		case !m.expires.After(now):
+			expired = append(expired, m)
+		default:
+			ready = append(ready, m)
+			if next.IsZero() || m.expires.Before(next) {
+				next = m.expires
+			}
+		}
+	}
+	q.ready = ready
+
+	for _, m := range expired {
+		q.deadLetter(m, "expired")
+	}
+
+	if next.IsZero() || q.deleted {
+		return
+	}
+
+	q.ttlTimer = time.AfterFunc(next.Sub(now), func() {
+		q.s.mu.Lock()
+		defer q.s.mu.Unlock()
+
+		if !q.deleted {
+			q.expire()
+			q.dispatch()
+		}
+	})
+}
+
+// deadLetter republishes the message to the dead letter exchange,
+// the message is dropped if the queue has no dead letter exchange
+func (q *queue) deadLetter(m *message, reason string) {
+	if !q.hasDLX || q.stream {
+		return
+	}
+
+	key := m.routingKey
+	if q.hasDLK {
+		key = q.dlk
+	}
+
+	d := m.clone()
+	d.exchange, d.routingKey = q.dlx, key
+	d.redelivered = false
+	d.expires = time.Time{}
+	d.props.Expiration = ""
+	if d.props.Headers == nil {
+		d.props.Headers = amqp.Table{}
+	}
+	d.props.Headers["x-death"] = death(d.props.Headers["x-death"], q.name, reason, m)
+
+	queues, err := q.s.route(d.exchange, d.routingKey, d.props.Headers)
+	if err == nil {
+		q.s.deliver(d, queues)
+	}
+}
+
+// death returns the x-death header with the dead-lettering recorded
+func death(v interface{}, queue, reason string, m *message) []interface{} {
+	deaths, _ := v.([]interface{})
+
+	for i, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == queue && t["reason"] == reason {
+			count, _ := integer(t["count"])
+			t["count"] = count + 1
+			t["time"] = time.Now()
+			// the latest death comes first
+			return append([]interface{}{t}, append(deaths[:i:i], deaths[i+1:]...)...)
+		}
+	}
+
+	return append([]interface{}{amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.routingKey},
+	}}, deaths...)
+}
+
+func (q *queue) addConsumer(c *consumer) {
+	q.consumers = append(q.consumers, c)
+	if q.expiryTimer != nil {
+		q.expiryTimer.Stop()
+		q.expiryTimer = nil
+	}
+}
+
+func (q *queue) removeConsumer(c *consumer) {
+	for i, it := range q.consumers {
+		if it == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+
+	if q.autoDelete && len(q.consumers) == 0 {
+		q.s.deleteQueue(q)
+		return
+	}
+
+	q.touch()
+}
+
+// touch restarts the countdown of x-expires while the queue is unused
+func (q *queue) touch() {
+	if q.expires <= 0 || len(q.consumers) > 0 || q.deleted {
+		return
+	}
+
+	if q.expiryTimer != nil {
+		q.expiryTimer.Stop()
+	}
+
+	timer := time.AfterFunc(q.expires, func() {
+		q.s.mu.Lock()
+		defer q.s.mu.Unlock()
+
+		if q.expiryTimer != nil && !q.deleted && len(q.consumers) == 0 {
+			q.s.deleteQueue(q)
+		}
+	})
+	q.expiryTimer = timer
+}
+
+// delete drops the messages and cancels the consumers,
+// it returns the number of dropped messages
+func (q *queue) delete() int {
+	if q.deleted {
+		return 0
+	}
+	q.deleted = true
+
+	if q.ttlTimer != nil {
+		q.ttlTimer.Stop()
+	}
+	if q.expiryTimer != nil {
+		q.expiryTimer.Stop()
+		q.expiryTimer = nil
+	}
+
+	consumers := q.consumers
+	q.consumers = nil
+	for _, c := range consumers {
+		c.ch.cancel(c)
+	}
+
+	n := len(q.ready)
+	q.ready = nil
+	return n
+}
+
+// integer returns the value of an integer field
+func integer(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case byte:
+		return int64(i), true
+	case int16:
+		return int64(i), true
+	case int32:
+		return int64(i), true
+	case int64:
+		return i, true
+	case int:
+		return int64(i), true
+	}
+
+	return 0, false
+}
+
+// equalField compares field values, integers of different sizes are equal
+// if their values are
+func equalField(a, b interface{}) bool {
+	if i, ok := integer(a); ok {
+		j, ok := integer(b)
+		return ok && i == j
+	}
+
+	return reflect.DeepEqual(a, b)
+}
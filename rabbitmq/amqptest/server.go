@@ -0,0 +1,316 @@
+// Package amqptest provides an in-process AMQP 0-9-1 server for testing,
+// it speaks enough of the protocol for the rabbitmq backend to run against it:
+//
+//	s, _ := amqptest.NewServer()
+//	defer s.Close()
+//
+//	q, _ := rabbitmq.NewQueue("default", &rabbitmq.QueueOption{URL: s.URL()})
+//
+// Supported are exchange declare and delete (direct, fanout, topic, headers and the
+// x-delayed-message type of the delayed message plugin), queue declare,
+// bind, unbind, purge and delete, publish, consume, get, qos, ack, nack, reject, recover,
+// publisher confirms, mandatory returns, and the queue arguments x-message-ttl, x-expires,
+// x-max-priority, x-dead-letter-exchange, x-dead-letter-routing-key, x-max-length,
+// x-max-length-bytes, x-overflow and x-single-active-consumer. Stream queues keep their
+// messages in a log, which consumers read from the x-stream-offset consumer argument.
+// NewTLSServer serves amqps and accepts the EXTERNAL mechanism, Clients reports
+// the handshake of connected clients. Messages are kept in memory, durability is ignored.
+//
+// The server is a stand-in, not a reference: the rabbitmq tests also run against RabbitMQ
+// when AMQP_URL is set, behaviours only tested against this server may differ from the broker.
+package amqptest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ibllex/go-queue/internal"
+	"github.com/streadway/amqp"
+)
+
+// Server is an in-process AMQP broker listening on a random local port
+type Server struct {
+	ln  net.Listener
+	tls bool
+
+	// mu guards the broker state, including connections and channels
+	mu        sync.Mutex
+	conns     map[*conn]struct{}
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	seq       uint64
+	closed    bool
+}
+
+// Client is the handshake of a client connection
+type Client struct {
+	// Properties are the client properties, e.g. connection_name
+	Properties amqp.Table
+	// Mechanism is the SASL mechanism used to authenticate
+	Mechanism string
+	Vhost     string
+	Heartbeat time.Duration
+	FrameMax  int
+}
+
+// NewServer starts a server listening on 127.0.0.1
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("amqptest: listen error: %s", err)
+	}
+
+	return newServer(ln, false), nil
+}
+
+// NewTLSServer starts a server accepting TLS connections on 127.0.0.1,
+// the EXTERNAL mechanism is accepted from clients presenting a certificate
+func NewTLSServer(config *tls.Config) (*Server, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, fmt.Errorf("amqptest: listen error: %s", err)
+	}
+
+	return newServer(ln, true), nil
+}
+
+func newServer(ln net.Listener, tls bool) *Server {
+	s := &Server{
+		ln:        ln,
+		tls:       tls,
+		conns:     make(map[*conn]struct{}),
+		exchanges: make(map[string]*exchange),
+		queues:    make(map[string]*queue),
+	}
+
+	// the predeclared exchanges
+	for name, kind := range map[string]string{
+		"amq.direct":  kindDirect,
+		"amq.fanout":  kindFanout,
+		"amq.topic":   kindTopic,
+		"amq.headers": kindHeaders,
+		"amq.match":   kindHeaders,
+	} {
+		s.exchanges[name] = &exchange{name: name, kind: kind, durable: true}
+	}
+
+	go s.serve()
+	return s
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// URL returns the AMQP URI of the server, any credentials are accepted
+func (s *Server) URL() string {
+	if s.tls {
+		return "amqps://guest:guest@" + s.Addr() + "/"
+	}
+
+	return "amqp://guest:guest@" + s.Addr() + "/"
+}
+
+// Clients returns the handshakes of the open client connections
+func (s *Server) Clients() []Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var clients []Client
+	for c := range s.conns {
+		if c.opened && !c.dead {
+			clients = append(clients, c.client)
+		}
+	}
+
+	return clients
+}
+
+// mechanisms are the SASL mechanisms offered to clients
+func (s *Server) mechanisms() string {
+	if s.tls {
+		return "PLAIN AMQPLAIN EXTERNAL"
+	}
+
+	return "PLAIN AMQPLAIN"
+}
+
+// Close stops the server, connected clients receive a connection.close
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+	s.CloseConnections()
+
+	return err
+}
+
+// CloseConnections forcibly closes all client connections as a broker shutdown does,
+// the server keeps running so that clients can reconnect
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.fail(&amqpError{
+			code: replyConnectionForced,
+			text: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+			hard: true,
+		})
+	}
+}
+
+// CancelConsumers cancels the consumers of the queue as a node failover does,
+// it returns the number of cancelled consumers
+func (s *Server) CancelConsumers(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[name]
+	if !ok {
+		return 0
+	}
+
+	consumers := append([]*consumer(nil), q.consumers...)
+	for _, c := range consumers {
+		q.removeConsumer(c)
+		c.ch.cancel(c)
+	}
+
+	return len(consumers)
+}
+
+// QueueSize returns the number of ready messages in the queue, and false if it does not exist
+func (s *Server) QueueSize(name string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[name]
+	if !ok {
+		return 0, false
+	}
+
+	return q.size(), true
+}
+
+func (s *Server) serve() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+
+		c := newConn(s, nc)
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+//
+// Routing, the caller must hold mu
+//
+
+// route returns the queues which the message published to the exchange is routed to
+func (s *Server) route(exchange, key string, headers amqp.Table) ([]*queue, *amqpError) {
+	if exchange == "" {
+		if q, ok := s.queues[key]; ok {
+			return []*queue{q}, nil
+		}
+		return nil, nil
+	}
+
+	e, ok := s.exchanges[exchange]
+	if !ok {
+		return nil, &amqpError{
+			code: replyNotFound,
+			text: fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", exchange),
+		}
+	}
+
+	return e.route(key, headers), nil
+}
+
+// deliver routes a copy of the message to each queue,
+// it returns false if any of them rejects the message
+func (s *Server) deliver(m *message, queues []*queue) bool {
+	accepted := true
+	for _, q := range queues {
+		s.seq++
+		c := m.clone()
+		c.seq = s.seq
+		if !q.enqueue(c) {
+			accepted = false
+		}
+	}
+
+	return accepted
+}
+
+func (s *Server) declareQueue(name string, owner *conn, durable, exclusive, autoDelete bool, args map[string]interface{}) *queue {
+	if name == "" {
+		name = "amq.gen-" + internal.RandomString(22)
+	}
+
+	q := newQueue(s, name, durable, exclusive, autoDelete, args)
+	if exclusive {
+		q.owner = owner
+	}
+
+	s.queues[name] = q
+	q.touch()
+
+	return q
+}
+
+func (s *Server) deleteQueue(q *queue) int {
+	if s.queues[q.name] == q {
+		delete(s.queues, q.name)
+	}
+
+	for _, e := range s.exchanges {
+		s.unbind(e, func(b *binding) bool { return b.q == q })
+	}
+
+	return q.delete()
+}
+
+// delay routes the message published to the delayed exchange after the delay,
+// it is dropped if the exchange is deleted in the meantime
+func (s *Server) delay(e *exchange, m *message, delay time.Duration) {
+	m = m.clone()
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.exchanges[e.name] == e {
+			s.deliver(m, e.route(m.routingKey, m.props.Headers))
+		}
+	})
+}
+
+// unbind removes the bindings of the exchange matching fn,
+// an auto-delete exchange is deleted when its last binding is removed
+func (s *Server) unbind(e *exchange, fn func(b *binding) bool) {
+	if e.unbind(fn) && e.autoDelete && len(e.bindings) == 0 {
+		delete(s.exchanges, e.name)
+	}
+}
@@ -0,0 +1,475 @@
+package amqptest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue/rabbitmq/amqptest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func dial(t *testing.T) (*amqptest.Server, *amqp.Connection, *amqp.Channel) {
+	s, err := amqptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := amqp.Dial(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, conn, ch
+}
+
+func publish(t *testing.T, ch *amqp.Channel, key string, bodies ...string) {
+	for _, body := range bodies {
+		assert.Nil(t, ch.Publish("", key, false, false, amqp.Publishing{Body: []byte(body)}))
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no message is delivered")
+		return amqp.Delivery{}
+	}
+}
+
+func TestServer(t *testing.T) {
+
+	t.Run("declare", func(t *testing.T) {
+		_, _, ch := dial(t)
+
+		q, err := ch.QueueDeclare("test", true, false, false, false, amqp.Table{"x-max-priority": int32(5)})
+		assert.Nil(t, err)
+		assert.Equal(t, "test", q.Name)
+
+		// integers of different sizes are equivalent
+		_, err = ch.QueueDeclare("test", true, false, false, false, amqp.Table{"x-max-priority": int64(5)})
+		assert.Nil(t, err)
+
+		q, err = ch.QueueDeclare("", false, true, true, false, nil)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, q.Name)
+
+		_, err = ch.QueueDeclare("test", false, false, false, false, nil)
+		assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+
+		_, err = ch.QueueDeclarePassive("unknown", false, false, false, false, nil)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("invalid expires", func(t *testing.T) {
+		for _, expires := range []int64{0, -1} {
+			_, _, ch := dial(t)
+
+			_, err := ch.QueueDeclare("test", true, false, false, false, amqp.Table{"x-expires": expires})
+			assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+		}
+	})
+
+	t.Run("publish and consume", func(t *testing.T) {
+		s, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+
+		publish(t, ch, "test", "a", "b", "c")
+		q, _ := ch.QueueDeclarePassive("test", true, false, false, false, nil)
+		assert.Equal(t, 3, q.Messages)
+
+		deliveries, err := ch.Consume("test", "", false, false, false, false, nil)
+		assert.Nil(t, err)
+
+		for _, body := range []string{"a", "b", "c"} {
+			d := receive(t, deliveries)
+			assert.Equal(t, body, string(d.Body))
+			assert.Nil(t, d.Ack(false))
+		}
+
+		size, _ := s.QueueSize("test")
+		assert.Equal(t, 0, size)
+	})
+
+	t.Run("large message", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+
+		body := make([]byte, 1<<20)
+		for i := range body {
+			body[i] = byte(i)
+		}
+		assert.Nil(t, ch.Publish("", "test", false, false, amqp.Publishing{
+			Body:    body,
+			Headers: amqp.Table{"x-test": "value", "count": int32(1)},
+		}))
+
+		d, ok, err := ch.Get("test", true)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, body, d.Body)
+		assert.Equal(t, amqp.Table{"x-test": "value", "count": int32(1)}, d.Headers)
+	})
+
+	t.Run("reject and requeue", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+		publish(t, ch, "test", "a", "b")
+
+		ch.Qos(1, 0, false)
+		deliveries, _ := ch.Consume("test", "", false, false, false, false, nil)
+
+		d := receive(t, deliveries)
+		assert.Equal(t, "a", string(d.Body))
+		assert.False(t, d.Redelivered)
+		assert.Nil(t, d.Reject(true))
+
+		// the message goes back to its original position
+		d = receive(t, deliveries)
+		assert.Equal(t, "a", string(d.Body))
+		assert.True(t, d.Redelivered)
+		d.Ack(false)
+
+		d = receive(t, deliveries)
+		assert.Equal(t, "b", string(d.Body))
+		d.Ack(false)
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		s, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+		publish(t, ch, "test", "a", "b", "c")
+
+		assert.Nil(t, ch.Qos(1, 0, false))
+		deliveries, _ := ch.Consume("test", "", false, false, false, false, nil)
+
+		d := receive(t, deliveries)
+		select {
+		case <-deliveries:
+			t.Fatal("prefetch is not respected")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		size, _ := s.QueueSize("test")
+		assert.Equal(t, 2, size)
+
+		d.Ack(false)
+		receive(t, deliveries)
+	})
+
+	t.Run("unacked messages are requeued on close", func(t *testing.T) {
+		s, conn, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+		publish(t, ch, "test", "a")
+
+		_, ok, _ := ch.Get("test", false)
+		assert.True(t, ok)
+		assert.Nil(t, ch.Close())
+
+		size, _ := s.QueueSize("test")
+		assert.Equal(t, 1, size)
+
+		ch, _ = conn.Channel()
+		d, ok, _ := ch.Get("test", true)
+		assert.True(t, ok)
+		assert.True(t, d.Redelivered)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+		publish(t, ch, "test", "a", "b")
+
+		n, err := ch.QueuePurge("test", false)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, n)
+
+		_, ok, _ := ch.Get("test", true)
+		assert.False(t, ok)
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, amqp.Table{"x-max-priority": int32(5)})
+
+		for i, p := range []uint8{0, 9, 3} {
+			ch.Publish("", "test", false, false, amqp.Publishing{Priority: p, Body: []byte{byte('a' + i)}})
+		}
+
+		var bodies string
+		for i := 0; i < 3; i++ {
+			d, _, _ := ch.Get("test", true)
+			bodies += string(d.Body)
+		}
+		assert.Equal(t, "bca", bodies)
+	})
+
+	t.Run("dead letter after ttl", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+		ch.QueueDeclare("test.delay", true, false, false, false, amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "test",
+			"x-message-ttl":             int64(50),
+		})
+
+		deliveries, _ := ch.Consume("test", "", true, false, false, false, nil)
+
+		start := time.Now()
+		publish(t, ch, "test.delay", "a")
+
+		d := receive(t, deliveries)
+		assert.Equal(t, "a", string(d.Body))
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+		deaths, _ := d.Headers["x-death"].([]interface{})
+		assert.Len(t, deaths, 1)
+		assert.Equal(t, "expired", deaths[0].(amqp.Table)["reason"])
+		assert.Equal(t, "test.delay", deaths[0].(amqp.Table)["queue"])
+	})
+
+	t.Run("dead letter rejected", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test.dead", true, false, false, false, nil)
+		ch.QueueDeclare("test", true, false, false, false, amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "test.dead",
+		})
+		publish(t, ch, "test", "a")
+
+		d, _, _ := ch.Get("test", false)
+		assert.Nil(t, d.Nack(false, false))
+
+		d, ok, _ := ch.Get("test.dead", true)
+		assert.True(t, ok)
+		assert.Equal(t, "a", string(d.Body))
+	})
+
+	t.Run("confirms and returns", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+
+		assert.Nil(t, ch.Confirm(false))
+		confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+		returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+		ch.Publish("", "test", true, false, amqp.Publishing{Body: []byte("a")})
+		ch.Publish("", "unknown", true, false, amqp.Publishing{Body: []byte("b")})
+
+		r := <-returns
+		assert.Equal(t, "b", string(r.Body))
+		assert.Equal(t, uint16(amqp.NoRoute), r.ReplyCode)
+
+		assert.Equal(t, amqp.Confirmation{DeliveryTag: 1, Ack: true}, <-confirms)
+		assert.Equal(t, amqp.Confirmation{DeliveryTag: 2, Ack: true}, <-confirms)
+	})
+
+	t.Run("exclusive queues are deleted with the connection", func(t *testing.T) {
+		s, conn, ch := dial(t)
+		q, _ := ch.QueueDeclare("", false, true, true, false, nil)
+		_, ok := s.QueueSize(q.Name)
+		assert.True(t, ok)
+
+		conn.Close()
+		assert.Eventually(t, func() bool {
+			_, ok := s.QueueSize(q.Name)
+			return !ok
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("exchanges", func(t *testing.T) {
+		_, _, ch := dial(t)
+		for _, name := range []string{"a", "b", "c"} {
+			ch.QueueDeclare(name, true, false, false, false, nil)
+		}
+
+		received := func(name string) []string {
+			var bodies []string
+			for {
+				d, ok, _ := ch.Get(name, true)
+				if !ok {
+					return bodies
+				}
+				bodies = append(bodies, string(d.Body))
+			}
+		}
+
+		assert.Nil(t, ch.ExchangeDeclare("direct", "direct", true, false, false, false, nil))
+		assert.Nil(t, ch.QueueBind("a", "red", "direct", false, nil))
+		assert.Nil(t, ch.QueueBind("b", "red", "direct", false, nil))
+		assert.Nil(t, ch.QueueBind("b", "green", "direct", false, nil))
+		ch.Publish("direct", "red", false, false, amqp.Publishing{Body: []byte("red")})
+		ch.Publish("direct", "green", false, false, amqp.Publishing{Body: []byte("green")})
+		assert.Equal(t, []string{"red"}, received("a"))
+		assert.Equal(t, []string{"red", "green"}, received("b"))
+
+		assert.Nil(t, ch.ExchangeDeclare("fanout", "fanout", true, false, false, false, nil))
+		ch.QueueBind("a", "", "fanout", false, nil)
+		ch.QueueBind("c", "", "fanout", false, nil)
+		ch.Publish("fanout", "any", false, false, amqp.Publishing{Body: []byte("all")})
+		assert.Equal(t, []string{"all"}, received("a"))
+		assert.Equal(t, []string{"all"}, received("c"))
+
+		assert.Nil(t, ch.ExchangeDeclare("topic", "topic", true, false, false, false, nil))
+		ch.QueueBind("a", "orders.*", "topic", false, nil)
+		ch.QueueBind("b", "orders.#", "topic", false, nil)
+		ch.QueueBind("c", "#.eu", "topic", false, nil)
+		for _, key := range []string{"orders", "orders.created", "orders.created.eu"} {
+			ch.Publish("topic", key, false, false, amqp.Publishing{Body: []byte(key)})
+		}
+		assert.Equal(t, []string{"orders.created"}, received("a"))
+		assert.Equal(t, []string{"orders", "orders.created", "orders.created.eu"}, received("b"))
+		assert.Equal(t, []string{"orders.created.eu"}, received("c"))
+
+		assert.Nil(t, ch.ExchangeDeclare("headers", "headers", true, false, false, false, nil))
+		ch.QueueBind("a", "", "headers", false, amqp.Table{"type": "order", "region": "eu"})
+		ch.QueueBind("b", "", "headers", false, amqp.Table{"x-match": "any", "type": "order", "region": "eu"})
+		ch.Publish("headers", "", false, false, amqp.Publishing{Headers: amqp.Table{"type": "order", "region": "eu"}, Body: []byte("eu")})
+		ch.Publish("headers", "", false, false, amqp.Publishing{Headers: amqp.Table{"type": "order", "region": "us"}, Body: []byte("us")})
+		assert.Equal(t, []string{"eu"}, received("a"))
+		assert.Equal(t, []string{"eu", "us"}, received("b"))
+
+		// unbound and deleted queues are no longer routed to
+		assert.Nil(t, ch.QueueUnbind("a", "red", "direct", nil))
+		ch.QueueDelete("b", false, false, false)
+		ch.Publish("direct", "red", false, false, amqp.Publishing{Body: []byte("red")})
+		assert.Empty(t, received("a"))
+
+		err := ch.ExchangeDeclare("direct", "topic", true, false, false, false, nil)
+		assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+	})
+
+	t.Run("unknown exchange", func(t *testing.T) {
+		_, conn, ch := dial(t)
+
+		err := ch.ExchangeDeclarePassive("unknown", "direct", true, false, false, false, nil)
+		assert.Equal(t, amqp.NotFound, err.(*amqp.Error).Code)
+
+		ch, _ = conn.Channel()
+		ch.QueueDeclare("test", true, false, false, false, nil)
+		err = ch.QueueBind("test", "", "unknown", false, nil)
+		assert.Equal(t, amqp.NotFound, err.(*amqp.Error).Code)
+	})
+
+	t.Run("max length", func(t *testing.T) {
+		s, _, ch := dial(t)
+		ch.QueueDeclare("dropped", true, false, false, false, nil)
+		ch.QueueDeclare("head", true, false, false, false, amqp.Table{
+			"x-max-length":              int32(2),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "dropped",
+		})
+		ch.QueueDeclare("reject", true, false, false, false, amqp.Table{
+			"x-max-length": int32(2),
+			"x-overflow":   "reject-publish",
+		})
+
+		publish(t, ch, "head", "a", "b", "c")
+		d, _, _ := ch.Get("head", true)
+		assert.Equal(t, "b", string(d.Body))
+		d, _, _ = ch.Get("dropped", true)
+		assert.Equal(t, "a", string(d.Body))
+
+		assert.Nil(t, ch.Confirm(false))
+		confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 3))
+		publish(t, ch, "reject", "a", "b", "c")
+		for _, ack := range []bool{true, true, false} {
+			assert.Equal(t, ack, (<-confirms).Ack)
+		}
+
+		size, _ := s.QueueSize("reject")
+		assert.Equal(t, 2, size)
+	})
+
+	t.Run("single active consumer", func(t *testing.T) {
+		_, conn, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, amqp.Table{"x-single-active-consumer": true})
+
+		ch2, _ := conn.Channel()
+		first, _ := ch.Consume("test", "first", true, false, false, false, nil)
+		second, _ := ch2.Consume("test", "second", true, false, false, false, nil)
+
+		publish(t, ch, "test", "a", "b")
+		assert.Equal(t, "a", string(receive(t, first).Body))
+		assert.Equal(t, "b", string(receive(t, first).Body))
+
+		// the next consumer becomes active once the first one is cancelled
+		assert.Nil(t, ch.Cancel("first", false))
+		publish(t, ch, "test", "c")
+		assert.Equal(t, "c", string(receive(t, second).Body))
+	})
+
+	t.Run("delayed exchange", func(t *testing.T) {
+		_, _, ch := dial(t)
+		ch.QueueDeclare("test", true, false, false, false, nil)
+
+		assert.Nil(t, ch.ExchangeDeclare("delayed", "x-delayed-message", true, false, false, false, amqp.Table{"x-delayed-type": "direct"}))
+		assert.Nil(t, ch.QueueBind("test", "test", "delayed", false, nil))
+		deliveries, _ := ch.Consume("test", "", true, false, false, false, nil)
+
+		start := time.Now()
+		ch.Publish("delayed", "test", false, false, amqp.Publishing{Headers: amqp.Table{"x-delay": int64(50)}, Body: []byte("a")})
+		ch.Publish("delayed", "test", false, false, amqp.Publishing{Body: []byte("b")})
+
+		assert.Equal(t, "b", string(receive(t, deliveries).Body))
+		assert.Equal(t, "a", string(receive(t, deliveries).Body))
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+		err := ch.ExchangeDeclare("invalid", "x-delayed-message", true, false, false, false, nil)
+		assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		s, conn, ch := dial(t)
+		args := amqp.Table{"x-queue-type": "stream"}
+		_, err := ch.QueueDeclare("stream", true, false, false, false, args)
+		assert.Nil(t, err)
+		publish(t, ch, "stream", "a", "b", "c")
+
+		// consumers must set a prefetch count
+		ch.Qos(10, 0, false)
+		first, _ := ch.Consume("stream", "first", false, false, false, false, amqp.Table{"x-stream-offset": "first"})
+		for _, body := range []string{"a", "b", "c"} {
+			d := receive(t, first)
+			assert.Equal(t, body, string(d.Body))
+			d.Ack(false)
+		}
+
+		// messages are kept after they are acked
+		ch2, _ := conn.Channel()
+		ch2.Qos(10, 0, false)
+		offset, _ := ch2.Consume("stream", "offset", false, false, false, false, amqp.Table{"x-stream-offset": int64(1)})
+		d := receive(t, offset)
+		assert.Equal(t, "b", string(d.Body))
+		assert.Equal(t, int64(1), d.Headers["x-stream-offset"])
+		size, _ := s.QueueSize("stream")
+		assert.Equal(t, 3, size)
+
+		ch3, _ := conn.Channel()
+		_, err = ch3.Consume("stream", "", false, false, false, false, nil)
+		assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+	})
+
+	t.Run("close connections", func(t *testing.T) {
+		s, conn, _ := dial(t)
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		s.CloseConnections()
+		err := <-closed
+		assert.Equal(t, amqp.ConnectionForced, err.Code)
+
+		// the server keeps running
+		conn, err2 := amqp.Dial(s.URL())
+		assert.Nil(t, err2)
+		conn.Close()
+	})
+}
@@ -0,0 +1,95 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// QueueType is the type of the queue, see (https://www.rabbitmq.com/quorum-queues.html)
+// and (https://www.rabbitmq.com/streams.html) for more detail
+type QueueType string
+
+const (
+	QueueClassic QueueType = "classic"
+	QueueQuorum  QueueType = "quorum"
+	QueueStream  QueueType = "stream"
+)
+
+// Overflow is the behaviour of a queue which reaches its maximum length
+type Overflow string
+
+const (
+	// OverflowDropHead drops or dead-letters the oldest messages
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish rejects new messages, which are nacked with publisher confirms
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX rejects new messages and dead-letters them
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// arguments returns the x-arguments of the queue declared from the options
+func (q *Queue) arguments() amqp.Table {
+	opt := q.opt
+	arguments := amqp.Table{}
+
+	if opt.QueueType != "" {
+		arguments["x-queue-type"] = string(opt.QueueType)
+	}
+	if opt.Lazy {
+		arguments["x-queue-mode"] = "lazy"
+	}
+	if opt.MaxPriority > 0 {
+		arguments["x-max-priority"] = int32(opt.MaxPriority)
+	}
+	if opt.MaxLength > 0 {
+		arguments["x-max-length"] = int64(opt.MaxLength)
+	}
+	if opt.MaxLengthBytes > 0 {
+		arguments["x-max-length-bytes"] = int64(opt.MaxLengthBytes)
+	}
+	if opt.Overflow != "" {
+		arguments["x-overflow"] = string(opt.Overflow)
+	}
+	if opt.MessageTTL > 0 {
+		arguments["x-message-ttl"] = opt.MessageTTL.Milliseconds()
+	}
+	if opt.StreamMaxAge > 0 {
+		arguments["x-max-age"] = maxAge(opt.StreamMaxAge)
+	}
+	if opt.SingleActiveConsumer {
+		arguments["x-single-active-consumer"] = true
+	}
+	if opt.DeadLetterExchange != "" || opt.DeadLetterRoutingKey != "" {
+		arguments["x-dead-letter-exchange"] = opt.DeadLetterExchange
+	}
+	if opt.DeadLetterRoutingKey != "" {
+		arguments["x-dead-letter-routing-key"] = opt.DeadLetterRoutingKey
+	}
+
+	for k, v := range opt.Arguments {
+		arguments[k] = v
+	}
+
+	if len(arguments) == 0 {
+		return nil
+	}
+
+	return arguments
+}
+
+// declareQueue declares the queue with the same flags and arguments everywhere,
+// a passive declaration only checks that the queue exists
+func (q *Queue) declareQueue(ch *pooledChannel, passive bool) (amqp.Queue, error) {
+	declare := ch.QueueDeclare
+	if passive {
+		declare = ch.QueueDeclarePassive
+	}
+
+	return declare(
+		q.name,        //name
+		true,          //durable
+		false,         //delete when unused
+		false,         //exclusive
+		false,         //no wait
+		q.arguments(), //arguments
+	)
+}
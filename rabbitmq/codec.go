@@ -0,0 +1,155 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ibllex/go-encoding"
+	"github.com/streadway/amqp"
+)
+
+// content types and encodings of the built-in codecs
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGob     = "application/x-gob"
+	ContentTypeMsgPack = "application/msgpack"
+
+	// raw bytes are published as they are by the built-in codecs
+	ContentTypeOctetStream = "application/octet-stream"
+
+	ContentEncodingS2   = "s2"
+	ContentEncodingGzip = "gzip"
+)
+
+// legacyContentType is published by earlier versions regardless of the codec
+const legacyContentType = "text/plain"
+
+type codecKey struct {
+	contentType     string
+	contentEncoding string
+}
+
+// CodecRegistry picks the codec of a message by its content type and encoding,
+// so producers using different codecs can share a queue
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[codecKey]encoding.Codec
+}
+
+// Register the codec for messages with the content type and encoding
+func (r *CodecRegistry) Register(contentType, contentEncoding string, codec encoding.Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.codecs[codecKey{mediaType(contentType), strings.ToLower(contentEncoding)}] = codec
+}
+
+// Lookup returns the codec registered for the content type and encoding
+func (r *CodecRegistry) Lookup(contentType, contentEncoding string) (encoding.Codec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	codec, ok := r.codecs[codecKey{mediaType(contentType), strings.ToLower(contentEncoding)}]
+	return codec, ok
+}
+
+// NewCodecRegistry returns a registry with the json, gob and msgpack codecs,
+// uncompressed or compressed with s2 or gzip
+func NewCodecRegistry() *CodecRegistry {
+	r := &CodecRegistry{codecs: make(map[codecKey]encoding.Codec)}
+
+	compressors := map[string]encoding.Compressor{
+		"":                  nil,
+		ContentEncodingS2:   encoding.NewS2Compressor(),
+		ContentEncodingGzip: encoding.NewGzipCompressor(),
+	}
+
+	for contentEncoding, c := range compressors {
+		r.Register(ContentTypeJSON, contentEncoding, encoding.NewJsonCodec(c))
+		r.Register(ContentTypeGob, contentEncoding, encoding.NewGobCodec(c))
+		r.Register(ContentTypeMsgPack, contentEncoding, encoding.NewMsgPackCodec(c))
+		r.Register("application/x-msgpack", contentEncoding, encoding.NewMsgPackCodec(c))
+	}
+
+	return r
+}
+
+// mediaType removes the parameters of the content type, e.g. the charset
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// contentTypeOf returns the content type of the built-in codecs
+func contentTypeOf(codec encoding.Codec) string {
+	switch codec.(type) {
+	case *encoding.JsonCodec:
+		return ContentTypeJSON
+	case *encoding.GobCodec:
+		return ContentTypeGob
+	case *encoding.MsgPackCodec:
+		return ContentTypeMsgPack
+	}
+
+	return ContentTypeOctetStream
+}
+
+// contentOf returns the content type and encoding of the message encoded by the codec of the queue,
+// the built-in codecs publish bytes as they are and integers as plain text, without compressing them
+func (q *Queue) contentOf(msg interface{}) (string, string) {
+	switch q.opt.Codec.(type) {
+	case *encoding.JsonCodec, *encoding.GobCodec, *encoding.MsgPackCodec:
+	default:
+		return q.opt.ContentType, q.opt.ContentEncoding
+	}
+
+	// the same checks as the codecs, named integer types are written as plain text too
+	if _, ok := msg.([]byte); ok {
+		return ContentTypeOctetStream, ""
+	}
+
+	switch reflect.ValueOf(msg).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return legacyContentType, ""
+	}
+
+	return q.opt.ContentType, q.opt.ContentEncoding
+}
+
+// codecOf returns the codec of the delivery, messages published with the content type
+// and encoding of the queue, without a content type, or raw bytes are decoded by its Codec
+func (q *Queue) codecOf(d amqp.Delivery) encoding.Codec {
+	contentType := mediaType(d.ContentType)
+
+	if contentType == "" || contentType == legacyContentType || contentType == ContentTypeOctetStream ||
+		(contentType == mediaType(q.opt.ContentType) && strings.EqualFold(d.ContentEncoding, q.opt.ContentEncoding)) {
+		return q.opt.Codec
+	}
+
+	if codec, ok := q.opt.Codecs.Lookup(contentType, d.ContentEncoding); ok {
+		return codec
+	}
+
+	return unknownCodec{d.ContentType, d.ContentEncoding}
+}
+
+// unknownCodec fails to decode messages which have no registered codec
+type unknownCodec codecKey
+
+func (c unknownCodec) Marshal(interface{}) ([]byte, error) {
+	return nil, c.err()
+}
+
+func (c unknownCodec) Unmarshal([]byte, interface{}) error {
+	return c.err()
+}
+
+func (c unknownCodec) err() error {
+	return fmt.Errorf("rabbitmq: no codec for content type %q and encoding %q", c.contentType, c.contentEncoding)
+}
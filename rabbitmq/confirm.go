@@ -0,0 +1,277 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ibllex/go-queue/internal/logger"
+	"github.com/streadway/amqp"
+)
+
+// ConfirmMode controls how Publish and Later wait for the broker to confirm messages,
+// see (https://www.rabbitmq.com/confirms.html#publisher-confirms) for more detail
+type ConfirmMode int
+
+const (
+	// ConfirmNone does not enable publisher confirms, messages may be lost without an error
+	ConfirmNone ConfirmMode = iota
+	// ConfirmSync waits for the confirmation of each message before publishing the next one
+	ConfirmSync
+	// ConfirmBatch publishes all the messages of a call and waits for their confirmations together
+	ConfirmBatch
+	// ConfirmAsync does not wait, messages nacked or returned by the broker are reported to OnPublishError
+	ConfirmAsync
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+var (
+	ErrNacked         = errors.New("rabbitmq: message is nacked by the broker")
+	ErrConfirmTimeout = errors.New("rabbitmq: timeout waiting for the confirmation")
+	ErrUnconfirmed    = errors.New("rabbitmq: channel is closed before the message is confirmed")
+)
+
+// ReturnError is returned when a message can not be routed to any queue
+type ReturnError struct {
+	Code       uint16
+	Text       string
+	Exchange   string
+	RoutingKey string
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("rabbitmq: message is returned by the broker: %d %s", e.Code, e.Text)
+}
+
+// publishing is a message waiting for its confirmation
+type publishing struct {
+	msg  amqp.Publishing
+	done chan error
+
+	pub *publisher
+	tag uint64
+}
+
+func (p *publishing) wait(timeout time.Duration) error {
+	select {
+	case err := <-p.done:
+		return err
+	case <-time.After(timeout):
+		// a late confirmation is ignored
+		p.pub.forget(p)
+		return ErrConfirmTimeout
+	}
+}
+
+// publisher publishes messages on a channel and tracks their confirmations
+type publisher struct {
+	ch      *amqp.Channel
+	mode    ConfirmMode
+	onError func(msg amqp.Publishing, err error)
+
+	// serializes publishing, so the delivery tags match the order of pending
+	pubMu sync.Mutex
+	seq   uint64
+
+	mu      sync.Mutex
+	pending map[uint64]*publishing
+	// messages returned by the broker, by message id, until they are confirmed
+	returned map[string]*ReturnError
+}
+
+func newPublisher(ch *amqp.Channel, opt *QueueOption) (*publisher, error) {
+	p := &publisher{
+		ch:       ch,
+		mode:     opt.ConfirmMode,
+		onError:  opt.OnPublishError,
+		pending:  make(map[uint64]*publishing),
+		returned: make(map[string]*ReturnError),
+	}
+
+	var confirms chan amqp.Confirmation
+	if p.mode != ConfirmNone {
+		if err := ch.Confirm(false); err != nil {
+			return nil, fmt.Errorf("channel confirm error: %s", err)
+		}
+		confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return, 64))
+	go p.listen(returns, confirms)
+
+	return p, nil
+}
+
+func (p *publisher) listen(returns chan amqp.Return, confirms chan amqp.Confirmation) {
+
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				if returns = nil; confirms == nil {
+					return
+				}
+				continue
+			}
+			p.returns(r)
+
+		case c, ok := <-confirms:
+			if !ok {
+				p.close()
+				return
+			}
+
+			// the return of a message is notified before its confirmation
+			for drained := false; !drained && returns != nil; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						continue
+					}
+					p.returns(r)
+				default:
+					drained = true
+				}
+			}
+			p.confirm(c)
+		}
+	}
+}
+
+func (p *publisher) returns(r amqp.Return) {
+	err := &ReturnError{
+		Code:       r.ReplyCode,
+		Text:       r.ReplyText,
+		Exchange:   r.Exchange,
+		RoutingKey: r.RoutingKey,
+	}
+
+	if p.mode != ConfirmNone {
+		p.mu.Lock()
+		// the messages which are no longer waiting for their confirmations are not tracked
+		for _, m := range p.pending {
+			if m.msg.MessageId == r.MessageId {
+				p.returned[r.MessageId] = err
+				break
+			}
+		}
+		p.mu.Unlock()
+		return
+	}
+
+	p.report(amqp.Publishing{
+		Headers:         r.Headers,
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		CorrelationId:   r.CorrelationId,
+		ReplyTo:         r.ReplyTo,
+		Expiration:      r.Expiration,
+		MessageId:       r.MessageId,
+		Timestamp:       r.Timestamp,
+		Type:            r.Type,
+		UserId:          r.UserId,
+		AppId:           r.AppId,
+		Body:            r.Body,
+	}, err)
+}
+
+func (p *publisher) confirm(c amqp.Confirmation) {
+	p.mu.Lock()
+	pending, ok := p.pending[c.DeliveryTag]
+	delete(p.pending, c.DeliveryTag)
+
+	var err error
+	if ok {
+		if ret, returned := p.returned[pending.msg.MessageId]; returned {
+			delete(p.returned, pending.msg.MessageId)
+			err = ret
+		}
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if !c.Ack {
+		err = ErrNacked
+	}
+
+	p.resolve(pending, err)
+}
+
+// forget stops tracking the message
+func (p *publisher) forget(m *publishing) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, m.tag)
+	delete(p.returned, m.msg.MessageId)
+}
+
+// close fails the messages still waiting for their confirmations
+func (p *publisher) close() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[uint64]*publishing)
+	p.returned = make(map[string]*ReturnError)
+	p.mu.Unlock()
+
+	for _, m := range pending {
+		p.resolve(m, ErrUnconfirmed)
+	}
+}
+
+func (p *publisher) resolve(m *publishing, err error) {
+	if p.mode == ConfirmAsync {
+		if err != nil {
+			p.report(m.msg, err)
+		}
+		return
+	}
+
+	m.done <- err
+}
+
+func (p *publisher) report(msg amqp.Publishing, err error) {
+	if p.onError != nil {
+		p.onError(msg, err)
+		return
+	}
+
+	logger.Warnf("rabbitmq: publish %s error: %s", msg.MessageId, err)
+}
+
+// publish the message, the returned publishing is nil if confirms are not enabled
+func (p *publisher) publish(exchange, key string, mandatory bool, msg amqp.Publishing) (*publishing, error) {
+	p.pubMu.Lock()
+	defer p.pubMu.Unlock()
+
+	if p.mode == ConfirmNone {
+		return nil, p.ch.Publish(exchange, key, mandatory, false, msg)
+	}
+
+	m := &publishing{msg: msg, done: make(chan error, 1), pub: p}
+
+	p.mu.Lock()
+	p.seq++
+	m.tag = p.seq
+	p.pending[m.tag] = m
+	p.mu.Unlock()
+
+	if err := p.ch.Publish(exchange, key, mandatory, false, msg); err != nil {
+		// the delivery tag is only taken by published messages
+		p.mu.Lock()
+		p.seq--
+		delete(p.pending, m.tag)
+		p.mu.Unlock()
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,187 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrClosed = errors.New("rabbitmq: queue is closed")
+
+const (
+	defaultReconnectDelay    = 500 * time.Millisecond
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+// connect creates the channel pool of the connection, or of a new connection if conn is nil,
+// and declares the queue. The connection is watched so that it can be recovered
+func (q *Queue) connect(conn *amqp.Connection) (err error) {
+
+	dialed := conn == nil
+	if dialed {
+		if conn, err = q.dial(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				conn.Close()
+			}
+		}()
+	}
+
+	pool := newChannelPool(conn, q.opt)
+	if err = pool.with(q.declare); err != nil {
+		pool.close()
+		return err
+	}
+
+	q.connMu.Lock()
+	if q.closed {
+		q.connMu.Unlock()
+		pool.close()
+		return ErrClosed
+	}
+
+	q.conn, q.pool, q.dialed = conn, pool, dialed
+	// wake up the workers waiting for the new connection
+	close(q.reconnected)
+	q.reconnected = make(chan struct{})
+	q.connMu.Unlock()
+
+	go q.watch(conn)
+	return nil
+}
+
+// declare the exchanges, the queue and its bindings
+func (q *Queue) declare(ch *pooledChannel) error {
+	if err := q.declareExchanges(ch); err != nil {
+		return err
+	}
+
+	if _, err := q.declareQueue(ch, false); err != nil {
+		return fmt.Errorf("queue declare error: %s", err)
+	}
+
+	if err := q.declareDelayed(ch); err != nil {
+		return err
+	}
+
+	return q.bind(ch)
+}
+
+// watch reconnects when the connection is lost
+func (q *Queue) watch(conn *amqp.Connection) {
+	err, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || err == nil {
+		// closed by the application
+		return
+	}
+
+	q.reconnect(err)
+}
+
+// reconnect dials with exponential backoff until it succeeds or the queue is closed
+func (q *Queue) reconnect(cause error) {
+
+	if q.opt.OnDisconnect != nil {
+		q.opt.OnDisconnect(cause)
+	}
+
+	if !q.recoverable() {
+		return
+	}
+
+	delay := q.opt.ReconnectDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-q.done:
+			return
+		case <-time.After(delay):
+		}
+
+		err := q.connect(nil)
+		if err == nil {
+			if q.opt.OnReconnect != nil {
+				q.opt.OnReconnect(attempt)
+			}
+			return
+		}
+
+		if err == ErrClosed {
+			return
+		}
+
+		if q.opt.OnReconnectError != nil {
+			q.opt.OnReconnectError(attempt, err)
+		}
+
+		if delay *= 2; delay > q.opt.MaxReconnectDelay {
+			delay = q.opt.MaxReconnectDelay
+		}
+	}
+}
+
+// recoverable reports whether the connection can be recovered after it is lost
+func (q *Queue) recoverable() bool {
+	return q.opt.URL != "" && !q.opt.DisableReconnect
+}
+
+// connection returns the current connection, which may have been closed
+func (q *Queue) connection() *amqp.Connection {
+	q.connMu.RLock()
+	defer q.connMu.RUnlock()
+
+	return q.conn
+}
+
+// channels returns the channel pool of the current connection
+func (q *Queue) channels() *channelPool {
+	q.connMu.RLock()
+	defer q.connMu.RUnlock()
+
+	return q.pool
+}
+
+// waitReconnected blocks until conn is replaced by a new connection
+func (q *Queue) waitReconnected(done <-chan struct{}, conn *amqp.Connection) error {
+	for {
+		q.connMu.RLock()
+		current, reconnected := q.conn, q.reconnected
+		q.connMu.RUnlock()
+
+		if current != conn {
+			return nil
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-q.done:
+			return ErrClosed
+		case <-reconnected:
+		}
+	}
+}
+
+// Close stops reconnecting and closes the connection dialed by the queue,
+// a connection provided by QueueOption is left open and only the pooled channels are closed
+func (q *Queue) Close() error {
+	q.connMu.Lock()
+	if q.closed {
+		q.connMu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	conn, pool, dialed := q.conn, q.pool, q.dialed
+	q.connMu.Unlock()
+
+	pool.close()
+	if !dialed || conn.IsClosed() {
+		return nil
+	}
+
+	return conn.Close()
+}
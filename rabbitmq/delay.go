@@ -0,0 +1,153 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/streadway/amqp"
+)
+
+// DelayMode is how Later delays messages
+type DelayMode int
+
+const (
+	// DelayPerDuration declares a delay queue for each distinct delay,
+	// messages are dead-lettered to the queue when they expire
+	DelayPerDuration DelayMode = iota
+	// DelayTiered rounds delays up to the nearest of DelayTiers, so only a fixed set of
+	// delay queues are declared. Delays longer than the largest tier are rounded up to a multiple of it
+	DelayTiered
+	// DelayExchange publishes to an x-delayed-message exchange bound to the queue,
+	// which requires the rabbitmq_delayed_message_exchange plugin,
+	// see (https://github.com/rabbitmq/rabbitmq-delayed-message-exchange) for more detail
+	DelayExchange
+)
+
+// delayHeader is the delay in milliseconds of messages published to the delayed exchange
+const delayHeader = "x-delay"
+
+var defaultDelayTiers = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+}
+
+func (q *Queue) later(delay time.Duration, messages ...interface{}) error {
+	// the delays are in milliseconds, and the broker rejects a delay queue with an x-expires of 0
+	if delay < time.Millisecond {
+		return q.Publish(messages...)
+	}
+
+	switch q.opt.DelayMode {
+	case DelayExchange:
+		return q.publishDelayed(delay, messages)
+	case DelayTiered:
+		delay = q.tier(delay)
+	}
+
+	destination := q.name + ".delay." + strconv.FormatInt(delay.Microseconds(), 10)
+	arguments := amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": q.name,
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-expires":                 delay.Milliseconds() * 2,
+	}
+
+	err := q.channels().with(func(ch *pooledChannel) error {
+		_, err := ch.QueueDeclare(
+			destination, //name
+			true,        //durable
+			false,       //delete when unused
+			false,       //exclusive
+			false,       //no wait
+			arguments,   //arguments
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return q.publish("", destination, messages...)
+}
+
+// tier rounds the delay up to the nearest delay tier
+func (q *Queue) tier(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return delay
+	}
+
+	tiers := q.opt.DelayTiers
+	for _, t := range tiers {
+		if delay <= t {
+			return t
+		}
+	}
+
+	largest := tiers[len(tiers)-1]
+	return (delay + largest - 1) / largest * largest
+}
+
+// delayedExchange returns the name of the delayed exchange of the queue
+func (q *Queue) delayedExchange() string {
+	return q.name + ".delayed"
+}
+
+// declareDelayed declares the delayed exchange and binds the queue to it
+func (q *Queue) declareDelayed(ch *pooledChannel) error {
+	if q.opt.DelayMode != DelayExchange {
+		return nil
+	}
+
+	err := ch.ExchangeDeclare(
+		q.delayedExchange(),                    // name
+		"x-delayed-message",                    // kind
+		true,                                   // durable
+		false,                                  // delete when unused
+		false,                                  // internal
+		false,                                  // no wait
+		amqp.Table{"x-delayed-type": "direct"}, // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("delayed exchange declare error: %s", err)
+	}
+
+	err = ch.QueueBind(
+		q.name,              // name
+		q.name,              // key
+		q.delayedExchange(), // exchange
+		false,               // no wait
+		nil,                 // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("queue bind error: %s", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) publishDelayed(delay time.Duration, messages []interface{}) error {
+	envelopes := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		body, props := queue.Unwrap(msg)
+
+		headers := make(map[string]interface{}, len(props.Headers)+1)
+		for k, v := range props.Headers {
+			headers[k] = v
+		}
+		headers[delayHeader] = delay.Milliseconds()
+		props.Headers = headers
+
+		envelopes[i] = &queue.Envelope{Properties: props, Body: body}
+	}
+
+	return q.publish(q.delayedExchange(), q.name, envelopes...)
+}
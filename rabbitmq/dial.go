@@ -0,0 +1,61 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultHeartbeat   = 10 * time.Second
+	defaultDialTimeout = 30 * time.Second
+)
+
+// ExternalAuth authenticates with the SASL EXTERNAL mechanism, the broker identifies
+// the client by its TLS certificate, see (https://github.com/rabbitmq/rabbitmq-server/tree/master/deps/rabbitmq_auth_mechanism_ssl)
+type ExternalAuth struct{}
+
+func (ExternalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (ExternalAuth) Response() string {
+	return ""
+}
+
+// config returns the config used to dial the URL
+func (q *Queue) config() amqp.Config {
+	config := amqp.Config{
+		SASL:       q.opt.SASL,
+		Vhost:      q.opt.Vhost,
+		ChannelMax: q.opt.ChannelMax,
+		FrameSize:  q.opt.FrameSize,
+		Heartbeat:  q.opt.Heartbeat,
+		Locale:     "en_US",
+		Dial:       amqp.DefaultDial(q.opt.DialTimeout),
+	}
+
+	// the config is modified by the dial, e.g. the server name
+	if q.opt.TLSConfig != nil {
+		config.TLSClientConfig = q.opt.TLSConfig.Clone()
+	}
+
+	if q.opt.ConnectionName != "" {
+		config.Properties = amqp.Table{
+			"product":         "go-queue",
+			"connection_name": q.opt.ConnectionName,
+		}
+	}
+
+	return config
+}
+
+func (q *Queue) dial() (*amqp.Connection, error) {
+	conn, err := amqp.DialConfig(q.opt.URL, q.config())
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %s", err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,126 @@
+package rabbitmq
+
+import (
+	"fmt"
+
+	"github.com/ibllex/go-queue"
+	"github.com/streadway/amqp"
+)
+
+// RoutingKeyHeader is the message header overriding the routing key used by Publish,
+// it is removed from the headers before the message is published
+const RoutingKeyHeader = "x-routing-key"
+
+// Exchange describes an exchange declared by the queue
+type Exchange struct {
+	Name string
+	// Kind is direct, fanout, topic or headers. Default is direct
+	Kind string
+	// AutoDelete deletes the exchange when its last binding is removed
+	AutoDelete bool
+	// Passive only checks that the exchange exists,
+	// for exchanges owned by other services
+	Passive   bool
+	Arguments amqp.Table
+}
+
+// Binding binds the queue to an exchange
+type Binding struct {
+	// Exchange is the name of the exchange. Default is QueueOption.Exchange
+	Exchange string
+	// RoutingKey is the binding key, topic exchanges accept the "*" and "#" wildcards
+	RoutingKey string
+	// Headers are matched against the message headers by headers exchanges,
+	// set "x-match" to "any" to match any of them instead of all
+	Headers amqp.Table
+}
+
+// WithRoutingKey wraps the message, so it is published with the routing key
+// instead of QueueOption.RoutingKey. Later ignores it and always delivers to the queue itself
+func WithRoutingKey(msg interface{}, key string) *queue.Envelope {
+	body, props := queue.Unwrap(msg)
+
+	headers := make(map[string]interface{}, len(props.Headers)+1)
+	for k, v := range props.Headers {
+		headers[k] = v
+	}
+	headers[RoutingKeyHeader] = key
+	props.Headers = headers
+
+	return &queue.Envelope{Properties: props, Body: body}
+}
+
+// routingKey removes the routing key header from the properties
+func routingKey(props *queue.Properties) (string, bool) {
+	key, ok := props.Headers[RoutingKeyHeader].(string)
+	if !ok {
+		return "", false
+	}
+
+	headers := make(map[string]interface{}, len(props.Headers)-1)
+	for k, v := range props.Headers {
+		if k != RoutingKeyHeader {
+			headers[k] = v
+		}
+	}
+	props.Headers = headers
+
+	return key, true
+}
+
+func (q *Queue) declareExchanges(ch *pooledChannel) error {
+	for _, e := range q.opt.Exchanges {
+		kind := e.Kind
+		if kind == "" {
+			kind = amqp.ExchangeDirect
+		}
+
+		declare := ch.ExchangeDeclare
+		if e.Passive {
+			declare = ch.ExchangeDeclarePassive
+		}
+
+		err := declare(
+			e.Name,       // name
+			kind,         // kind
+			true,         // durable
+			e.AutoDelete, // delete when unused
+			false,        // internal
+			false,        // no wait
+			e.Arguments,  // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("exchange declare error: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// bind the queue, to Exchange with RoutingKey if no bindings are given
+func (q *Queue) bind(ch *pooledChannel) error {
+	bindings := q.opt.Bindings
+	if len(bindings) == 0 && q.opt.Exchange != "" {
+		bindings = []Binding{{RoutingKey: q.opt.RoutingKey}}
+	}
+
+	for _, b := range bindings {
+		exchange := b.Exchange
+		if exchange == "" {
+			exchange = q.opt.Exchange
+		}
+
+		err := ch.QueueBind(
+			q.name,       // name
+			b.RoutingKey, // key
+			exchange,     // exchange
+			false,        // no wait
+			b.Headers,    // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("queue bind error: %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package rabbitmq
+
+import (
+	"errors"
+
+	"github.com/ibllex/go-queue"
+	"github.com/streadway/amqp"
+)
+
+var ErrInspected = errors.New("rabbitmq: inspected messages can not be acked or rejected")
+
+// Peek returns up to n waiting messages in delivery order.
+// The messages are fetched and requeued, so their Redelivered flag is set,
+// and messages being fetched are invisible to the consumers meanwhile
+func (q *Queue) Peek(n int) ([]queue.Message, error) {
+	return q.List(0, n)
+}
+
+// List returns up to limit waiting messages in delivery order, skipping the first offset messages,
+// a negative limit lists all the messages. See Peek
+func (q *Queue) List(offset, limit int) ([]queue.Message, error) {
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	var messages []queue.Message
+	if limit == 0 {
+		return messages, nil
+	}
+
+	err := q.fetch(func(d amqp.Delivery) (bool, bool) {
+		if offset > 0 {
+			offset--
+			return true, false
+		}
+
+		m := NewMessage(d, q.codecOf(d))
+		m.inspected = true
+		messages = append(messages, m)
+
+		return limit < 0 || len(messages) < limit, false
+	})
+
+	return messages, err
+}
+
+// Delete removes the waiting message with the given id,
+// the messages before it are fetched and requeued, see Peek
+func (q *Queue) Delete(id string) error {
+
+	found := false
+	err := q.fetch(func(d amqp.Delivery) (bool, bool) {
+		found = d.MessageId == id
+		return !found, found
+	})
+
+	if err == nil && !found {
+		err = queue.ErrMessageNotFound
+	}
+
+	return err
+}
+
+// fetch gets messages from the queue until visit returns false for next or the queue is empty,
+// the messages visit asks to remove are acked, the others are requeued
+func (q *Queue) fetch(visit func(d amqp.Delivery) (next bool, remove bool)) error {
+
+	// create a temporary channel, the unacked messages are requeued when it is closed
+	ch, err := q.connection().Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for {
+		d, ok, err := ch.Get(q.name, false)
+		if err != nil || !ok {
+			return err
+		}
+
+		next, remove := visit(d)
+		if remove {
+			if err = d.Ack(false); err != nil {
+				return err
+			}
+		}
+
+		if !next {
+			return nil
+		}
+	}
+}
@@ -10,17 +10,37 @@ import (
 )
 
 type Message struct {
+	q        *Queue
 	codec    encoding.Codec
 	delivery amqp.Delivery
 
 	acked    bool
 	rejected bool
+	// inspected messages are returned by Peek and List
+	inspected bool
+}
+
+// ID returns the message id set by the publisher, which can be used to Delete it
+func (m *Message) ID() string {
+	return m.delivery.MessageId
 }
 
 func (m *Message) Name() string {
 	return strconv.FormatUint(m.delivery.DeliveryTag, 10)
 }
 
+// Redelivered reports whether the message may have been delivered before,
+// e.g. it was rejected or its consumer was lost before acking it
+func (m *Message) Redelivered() bool {
+	return m.delivery.Redelivered
+}
+
+// StreamOffset returns the offset of a message consumed from a stream, a worker
+// can resume after it with queue.FromOffset(offset + 1)
+func (m *Message) StreamOffset() (int64, bool) {
+	return streamOffsetOf(m.delivery)
+}
+
 func (m *Message) Unmarshal(value interface{}) error {
 	return m.codec.Unmarshal(m.delivery.Body, value)
 }
@@ -30,6 +50,10 @@ func (m *Message) Body() []byte {
 }
 
 func (m *Message) Reject() (err error) {
+	if m.inspected {
+		return ErrInspected
+	}
+
 	if m.acked {
 		return errors.New("you can not reject an acked message")
 	}
@@ -43,6 +67,10 @@ func (m *Message) Reject() (err error) {
 }
 
 func (m *Message) Ack() (err error) {
+	if m.inspected {
+		return ErrInspected
+	}
+
 	if m.rejected {
 		return errors.New("you can not ack a rejected message")
 	}
@@ -67,6 +95,28 @@ func (m *Message) Status() queue.MessageStatus {
 	return queue.Pending
 }
 
+func (m *Message) Properties() queue.Properties {
+	return queue.Properties{
+		Type:          m.delivery.Type,
+		CorrelationID: m.delivery.CorrelationId,
+		ReplyTo:       m.delivery.ReplyTo,
+		Priority:      m.delivery.Priority,
+		Headers:       m.delivery.Headers,
+	}
+}
+
+func (m *Message) Reply(v interface{}) error {
+	if m.delivery.ReplyTo == "" {
+		return queue.ErrNoReplyTo
+	}
+
+	if m.q == nil {
+		return errors.New("message is not bound to a queue")
+	}
+
+	return m.q.reply(m.delivery.ReplyTo, m.delivery.CorrelationId, v)
+}
+
 func NewMessage(delivery amqp.Delivery, codec encoding.Codec) *Message {
 	return &Message{
 		delivery: delivery,
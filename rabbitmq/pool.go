@@ -0,0 +1,129 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+const defaultChannelPoolSize = 8
+
+// pooledChannel is a channel with its publisher
+type pooledChannel struct {
+	*amqp.Channel
+	pub    *publisher
+	closed chan *amqp.Error
+}
+
+// broken reports whether the channel is closed, e.g. by an exception
+func (c *pooledChannel) broken() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// channelPool leases at most size channels of a connection at a time,
+// broken channels are discarded and replaced by new ones
+type channelPool struct {
+	conn *amqp.Connection
+	opt  *QueueOption
+
+	slots chan struct{}
+	idle  chan *pooledChannel
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newChannelPool(conn *amqp.Connection, opt *QueueOption) *channelPool {
+	return &channelPool{
+		conn:  conn,
+		opt:   opt,
+		slots: make(chan struct{}, opt.ChannelPoolSize),
+		idle:  make(chan *pooledChannel, opt.ChannelPoolSize),
+	}
+}
+
+// get leases a channel, it blocks until one is returned if all of them are leased
+func (p *channelPool) get() (*pooledChannel, error) {
+	p.slots <- struct{}{}
+
+	for {
+		select {
+		case c := <-p.idle:
+			if !c.broken() {
+				return c, nil
+			}
+		default:
+			c, err := p.open()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+}
+
+// put returns the leased channel to the pool
+func (p *channelPool) put(c *pooledChannel) {
+	p.mu.Lock()
+	if p.closed {
+		c.Close()
+	} else if !c.broken() {
+		p.idle <- c
+	}
+	p.mu.Unlock()
+
+	<-p.slots
+}
+
+// with leases a channel for fn
+func (p *channelPool) with(fn func(c *pooledChannel) error) error {
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer p.put(c)
+
+	return fn(c)
+}
+
+func (p *channelPool) open() (*pooledChannel, error) {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("create channel error: %s", err)
+	}
+
+	pub, err := newPublisher(ch, p.opt)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return &pooledChannel{
+		Channel: ch,
+		pub:     pub,
+		closed:  ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// close the idle channels, leased channels are closed when they are returned
+func (p *channelPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
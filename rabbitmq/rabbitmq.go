@@ -1,8 +1,8 @@
 package rabbitmq
 
 import (
-	"fmt"
-	"strconv"
+	"crypto/tls"
+	"sync"
 	"time"
 
 	"github.com/ibllex/go-encoding"
@@ -18,162 +18,328 @@ type QueueOption struct {
 	// if you do not provide the Connection parameter,
 	// we will try to create a new connection from the URL
 	URL string
+
+	// TLSConfig is used to dial amqps URLs, e.g. with the CA and the client certificate
+	TLSConfig *tls.Config
+	// SASL are the mechanisms tried in order to authenticate, e.g. ExternalAuth
+	// for the client certificate. Default is PLAIN with the credentials of the URL
+	SASL []amqp.Authentication
+	// Vhost replaces the virtual host of the URL
+	Vhost string
+	// Heartbeat is the heartbeat interval, the lower of it and the broker's is used. Default is 10s
+	Heartbeat time.Duration
+	// FrameSize is the maximum frame size in bytes, 0 is the broker's
+	FrameSize int
+	// ChannelMax is the maximum number of channels of the connection, 0 is the broker's
+	ChannelMax int
+	// ConnectionName is shown in the management UI to identify the connection
+	ConnectionName string
+	// DialTimeout is the timeout of the TCP, TLS and AMQP handshakes. Default is 30s
+	DialTimeout time.Duration
+
 	// Codec is using for marshal and unmarshal messages
 	// default is gob codec with s2 compression
 	Codec encoding.Codec
+	// ContentType is published with the messages encoded by Codec. Default is derived
+	// from the built-in json, gob and msgpack codecs, application/octet-stream otherwise.
+	// The built-in codecs do not encode bytes and integers, they are published as
+	// application/octet-stream and text/plain without ContentEncoding
+	ContentType string
+	// ContentEncoding is published with the messages encoded by Codec, set it to the
+	// compression of the Codec, e.g. ContentEncodingS2. Default is s2 for the default codec
+	ContentEncoding string
+	// Codecs decode the messages published with a different content type or encoding,
+	// e.g. by producers in other languages. Default is NewCodecRegistry()
+	Codecs *CodecRegistry
+	// MaxPriority enables message priority by declaring the queue with x-max-priority,
+	// messages with priority above it are treated as MaxPriority. Default is 0 (disabled),
+	// note that the arguments of an existing queue can not be changed
+	MaxPriority uint8
+
+	// QueueType is classic, quorum or stream, declared by x-queue-type. Default is classic
+	QueueType QueueType
+	// StreamMaxAge discards the messages of a stream older than it, 0 keeps them
+	// until MaxLengthBytes is reached. Workers read a stream from ConsumerOption.StartFrom
+	StreamMaxAge time.Duration
+	// Lazy keeps the messages of a classic queue on disk as early as possible
+	Lazy bool
+	// MaxLength limits the number of ready messages, 0 is unlimited
+	MaxLength int
+	// MaxLengthBytes limits the total body size of ready messages, 0 is unlimited
+	MaxLengthBytes int
+	// Overflow is what happens when MaxLength or MaxLengthBytes is reached. Default is OverflowDropHead
+	Overflow Overflow
+	// MessageTTL expires messages which are not consumed in time, 0 is never.
+	// Expired messages are dead-lettered if DeadLetterExchange is set
+	MessageTTL time.Duration
+	// SingleActiveConsumer delivers messages to one consumer at a time,
+	// the others take over in turn when it is cancelled
+	SingleActiveConsumer bool
+	// DeadLetterExchange receives the messages which are rejected, expired or dropped,
+	// use DeadLetterRoutingKey with the default exchange to dead-letter to a queue
+	DeadLetterExchange string
+	// DeadLetterRoutingKey replaces the routing key of dead-lettered messages
+	DeadLetterRoutingKey string
+	// DelayMode is how Later delays messages. Default is DelayPerDuration
+	DelayMode DelayMode
+	// DelayTiers are the delays which DelayTiered rounds up to, in ascending order.
+	// Default is 1s, 5s, 10s, 30s, 1m, 5m, 10m, 30m and 1h
+	DelayTiers []time.Duration
+
+	// Arguments are additional x-arguments of the queue, they take precedence over the fields above
+	Arguments amqp.Table
+
+	// Exchange is where Publish sends messages to. Default is the default exchange,
+	// which routes messages to the queue named by the routing key
+	Exchange string
+	// RoutingKey is the routing key used by Publish, it can be overridden per message
+	// by WithRoutingKey. Default is the queue name
+	RoutingKey string
+	// Exchanges are declared before the queue, durable
+	Exchanges []Exchange
+	// Bindings bind the queue to exchanges. Default is binding it to Exchange with RoutingKey,
+	// unless Exchange is the default exchange
+	Bindings []Binding
+
+	// ReconnectDelay is the delay before the first reconnect attempt after the connection is lost,
+	// it is doubled after each failed attempt up to MaxReconnectDelay. Default is 500ms
+	ReconnectDelay time.Duration
+	// MaxReconnectDelay is the maximum delay between reconnect attempts. Default is 30s
+	MaxReconnectDelay time.Duration
+	// DisableReconnect disables the automatic reconnection,
+	// note that reconnection also requires the URL to redial
+	DisableReconnect bool
+
+	// OnDisconnect is called when the connection is lost
+	OnDisconnect func(err error)
+	// OnReconnect is called after the connection is recovered,
+	// queues are redeclared and workers are resubscribed
+	OnReconnect func(attempt int)
+	// OnReconnectError is called when a reconnect attempt fails
+	OnReconnectError func(attempt int, err error)
+
+	// ChannelPoolSize is the maximum number of channels used by Publish, Later and Size
+	// at a time. Default is 8
+	ChannelPoolSize int
+
+	// ConfirmMode enables publisher confirms on the pooled channels, Publish and Later return
+	// an error if a message is nacked or can not be routed. Default is ConfirmNone
+	ConfirmMode ConfirmMode
+	// ConfirmTimeout is how long to wait for a confirmation. Default is 5s
+	ConfirmTimeout time.Duration
+	// OnPublishError is called when a message is nacked or returned but the error
+	// can not be returned to the publisher, with ConfirmAsync or ConfirmNone.
+	// Default is logging the error
+	OnPublishError func(msg amqp.Publishing, err error)
 }
 
 type Queue struct {
 	name string
 	opt  *QueueOption
 
-	conn *amqp.Connection
-	ch   *amqp.Channel
+	// current connection and its channel pool, replaced on reconnect
+	connMu      sync.RWMutex
+	conn        *amqp.Connection
+	pool        *channelPool
+	dialed      bool
+	reconnected chan struct{}
+	done        chan struct{}
+	closed      bool
+
+	// exclusive queue receiving replies and the pending calls
+	replyMu sync.Mutex
+	replyTo string
+	calls   sync.Map
+
+	// messages published by At
+	schedMu   sync.Mutex
+	schedules map[string]*schedule
 }
 
 func (q *Queue) Name() string {
 	return q.name
 }
 
-func (q *Queue) Size() int {
+// CarriesProperties implements queue.PropertiesPublisher
+func (q *Queue) CarriesProperties() bool {
+	return true
+}
 
-	// create a temporary channel, so the main channel will not be closed on exception
-	ch, err := q.conn.Channel()
-	if err != nil {
-		return 0
-	}
+func (q *Queue) Size() (size int) {
 
-	data, err := ch.QueueDeclarePassive(
-		q.name, //name
-		false,  //durable
-		true,   //delete when unused
-		false,  //exclusive
-		false,  //no wait
-		nil,    //arguments
-	)
+	// the channel is discarded by the pool if it is closed by an exception
+	q.channels().with(func(ch *pooledChannel) error {
+		data, err := q.declareQueue(ch, true)
+		size = data.Messages
+		return err
+	})
 
-	if err != nil {
-		return 0
-	}
+	return
+}
 
-	ch.Close()
-	return data.Messages
+func (q *Queue) Worker(opt *queue.ConsumerOption) queue.Worker {
+	opt = queue.DefaultConsumerOption(opt)
+	return NewWorker(opt.ID, q, opt)
 }
 
 func (q *Queue) Consumer(opt *queue.ConsumerOption) (*queue.Consumer, error) {
 	opt = queue.DefaultConsumerOption(opt)
-	return queue.NewConsumer(NewWorker(opt.ID, q, opt), opt)
+	return queue.NewConsumer(q.Worker(opt), opt)
 }
 
-func (q *Queue) Publish(messages ...interface{}) (err error) {
-
-	for _, msg := range messages {
-		err = q.publish(q.name, msg)
-		if err != nil {
-			return err
-		}
-	}
-
-	return
+func (q *Queue) Publish(messages ...interface{}) error {
+	return q.publish(q.opt.Exchange, q.opt.RoutingKey, messages...)
 }
 
 func (q *Queue) Later(delay time.Duration, messages ...interface{}) (err error) {
+	return q.later(delay, messages...)
+}
 
-	destination := q.name + ".delay." + strconv.FormatInt(delay.Microseconds(), 10)
-	arguments := amqp.Table{
-		"x-dead-letter-exchange":    "",
-		"x-dead-letter-routing-key": q.name,
-		"x-message-ttl":             delay.Milliseconds(),
-		"x-expires":                 delay.Milliseconds() * 2,
-	}
-
-	_, err = q.ch.QueueDeclare(
-		destination, //name
-		true,        //durable
-		false,       //delete when unused
-		false,       //exclusive
-		false,       //no wait
-		arguments,   //arguments
-	)
+// publish the messages and wait for their confirmations according to the ConfirmMode
+func (q *Queue) publish(exchange, key string, messages ...interface{}) error {
+
+	var batch []*publishing
+	err := q.channels().with(func(ch *pooledChannel) error {
+		for _, msg := range messages {
+			m, err := q.publishOne(ch.pub, exchange, key, msg)
+			if err != nil {
+				return err
+			}
+
+			switch q.opt.ConfirmMode {
+			case ConfirmSync:
+				if err = m.wait(q.opt.ConfirmTimeout); err != nil {
+					return err
+				}
+			case ConfirmBatch:
+				batch = append(batch, m)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, msg := range messages {
-		err = q.publish(destination, msg)
-		if err != nil {
+	// the channel can be leased by others while waiting for the batch
+	for _, m := range batch {
+		if err := m.wait(q.opt.ConfirmTimeout); err != nil {
 			return err
 		}
 	}
 
-	return
+	return nil
 }
 
-func (q *Queue) publish(destination string, msg interface{}) error {
+func (q *Queue) publishOne(pub *publisher, exchange, key string, msg interface{}) (*publishing, error) {
+
+	msg, props := queue.Unwrap(msg)
+	// the routing key of the message replaces the one of the queue
+	if k, ok := routingKey(&props); ok && exchange == q.opt.Exchange && key == q.opt.RoutingKey {
+		key = k
+	}
 
 	body, err := q.opt.Codec.Marshal(msg)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	contentType, contentEncoding := q.contentOf(msg)
+
+	if props.CorrelationID == "" {
+		props.CorrelationID = internal.RandomString(32)
 	}
 
-	return q.ch.Publish(
-		"",          // exchange
-		destination, // routing key
-		true,        // mandatory
-		false,       // immediate
+	// messages are returned by the delayed exchange as they can not be routed until the delay ends
+	mandatory := q.opt.DelayMode != DelayExchange || exchange != q.delayedExchange()
+
+	return pub.publish(
+		exchange,  // exchange
+		key,       // routing key
+		mandatory, // mandatory
 		amqp.Publishing{
-			CorrelationId: internal.RandomString(32),
-			ContentType:   "text/plain",
-			Body:          body,
-			DeliveryMode:  amqp.Persistent,
+			MessageId:       internal.RandomString(32),
+			CorrelationId:   props.CorrelationID,
+			ReplyTo:         props.ReplyTo,
+			Priority:        props.Priority,
+			Headers:         props.Headers,
+			ContentType:     contentType,
+			ContentEncoding: contentEncoding,
+			Type:            props.Type,
+			Body:            body,
+			DeliveryMode:    amqp.Persistent,
 		},
 	)
-
 }
 
 func (q *Queue) Purge() error {
-	_, err := q.ch.QueuePurge(q.name, false)
-	return err
+	return q.channels().with(func(ch *pooledChannel) error {
+		_, err := ch.QueuePurge(q.name, false)
+		return err
+	})
 }
 
 func NewQueue(name string, opt *QueueOption) (*Queue, error) {
 
-	var err error
-
-	if opt.Connection == nil {
-		opt.Connection, err = amqp.Dial(opt.URL)
-		if err != nil {
-			return nil, fmt.Errorf("dial error: %s", err)
+	if opt.Codec == nil {
+		opt.Codec = encoding.NewGobCodec(
+			encoding.NewS2Compressor(),
+		)
+		if opt.ContentType == "" {
+			opt.ContentType, opt.ContentEncoding = ContentTypeGob, ContentEncodingS2
 		}
 	}
 
-	ch, err := opt.Connection.Channel()
-	if err != nil {
-		return nil, fmt.Errorf("create channel error: %s", err)
+	if opt.ContentType == "" {
+		opt.ContentType = contentTypeOf(opt.Codec)
 	}
 
-	_, err = ch.QueueDeclare(
-		name,  //name
-		true,  //durable
-		false, //delete when unused
-		false, //exclusive
-		false, //no wait
-		nil,   //arguments
-	)
-	if err != nil {
-		return nil, fmt.Errorf("queue declare error: %s", err)
+	if opt.Codecs == nil {
+		opt.Codecs = NewCodecRegistry()
 	}
 
-	if opt.Codec == nil {
-		opt.Codec = encoding.NewGobCodec(
-			encoding.NewS2Compressor(),
-		)
+	if opt.RoutingKey == "" {
+		opt.RoutingKey = name
+	}
+
+	if opt.DelayMode == DelayTiered && len(opt.DelayTiers) == 0 {
+		opt.DelayTiers = defaultDelayTiers
+	}
+
+	if opt.ChannelPoolSize <= 0 {
+		opt.ChannelPoolSize = defaultChannelPoolSize
+	}
+
+	if opt.ConfirmTimeout <= 0 {
+		opt.ConfirmTimeout = defaultConfirmTimeout
+	}
+
+	if opt.Heartbeat <= 0 {
+		opt.Heartbeat = defaultHeartbeat
+	}
+
+	if opt.DialTimeout <= 0 {
+		opt.DialTimeout = defaultDialTimeout
+	}
+
+	if opt.ReconnectDelay <= 0 {
+		opt.ReconnectDelay = defaultReconnectDelay
+	}
+
+	if opt.MaxReconnectDelay <= 0 {
+		opt.MaxReconnectDelay = defaultMaxReconnectDelay
+	}
+
+	q := &Queue{
+		name:        name,
+		opt:         opt,
+		reconnected: make(chan struct{}),
+		done:        make(chan struct{}),
+		schedules:   make(map[string]*schedule),
+	}
+
+	if err := q.connect(opt.Connection); err != nil {
+		return nil, err
 	}
 
-	return &Queue{
-		name: name,
-		opt:  opt,
-		conn: opt.Connection,
-		ch:   ch,
-	}, err
+	return q, nil
 }
@@ -0,0 +1,110 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal"
+	"github.com/streadway/amqp"
+)
+
+func (q *Queue) Call(ctx context.Context, req interface{}, resp interface{}) error {
+
+	replyTo, err := q.replyQueue()
+	if err != nil {
+		return err
+	}
+
+	body, props := queue.Unwrap(req)
+	props.CorrelationID = internal.RandomString(32)
+	props.ReplyTo = replyTo
+
+	reply := make(chan amqp.Delivery, 1)
+	q.calls.Store(props.CorrelationID, reply)
+	defer q.calls.Delete(props.CorrelationID)
+
+	err = q.publish(q.opt.Exchange, q.opt.RoutingKey, &queue.Envelope{Properties: props, Body: body})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case d := <-reply:
+		if resp == nil {
+			return nil
+		}
+		return q.codecOf(d).Unmarshal(d.Body, resp)
+	}
+}
+
+// replyQueue returns the name of the exclusive queue receiving replies,
+// it is declared on first use and redeclared once its channel is closed
+func (q *Queue) replyQueue() (string, error) {
+
+	q.replyMu.Lock()
+	defer q.replyMu.Unlock()
+
+	if q.replyTo != "" {
+		return q.replyTo, nil
+	}
+
+	ch, err := q.connection().Channel()
+	if err != nil {
+		return "", fmt.Errorf("create channel error: %s", err)
+	}
+
+	rq, err := ch.QueueDeclare(
+		"",    //name
+		false, //durable
+		true,  //delete when unused
+		true,  //exclusive
+		false, //no wait
+		nil,   //arguments
+	)
+	if err != nil {
+		ch.Close()
+		return "", fmt.Errorf("reply queue declare error: %s", err)
+	}
+
+	deliveries, err := ch.Consume(
+		rq.Name, // queue
+		"",      // consumer
+		true,    // auto-ack
+		true,    // exclusive
+		false,   // noLocal
+		false,   // noWait
+		nil,     // arguments
+	)
+	if err != nil {
+		ch.Close()
+		return "", fmt.Errorf("reply queue consume error: %s", err)
+	}
+
+	go func() {
+		for d := range deliveries {
+			if c, ok := q.calls.Load(d.CorrelationId); ok {
+				select {
+				case c.(chan amqp.Delivery) <- d:
+				default:
+				}
+			}
+		}
+
+		q.replyMu.Lock()
+		q.replyTo = ""
+		q.replyMu.Unlock()
+	}()
+
+	q.replyTo = rq.Name
+	return q.replyTo, nil
+}
+
+func (q *Queue) reply(replyTo, id string, v interface{}) error {
+	return q.publish("", replyTo, &queue.Envelope{
+		Properties: queue.Properties{CorrelationID: id},
+		Body:       v,
+	})
+}
@@ -0,0 +1,277 @@
+package rabbitmq
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/internal"
+	"github.com/ibllex/go-queue/internal/logger"
+	"github.com/streadway/amqp"
+)
+
+const (
+	scheduleIDHeader  = "x-schedule-id"
+	scheduleRevHeader = "x-schedule-rev"
+
+	// how long the markers of schedules are kept after their due time, and the state of
+	// schedules after their latest due time, copies arriving later than that are not dropped
+	scheduleRetention = time.Hour
+)
+
+// schedule tracks messages published by At. Messages in the delay queues can not be
+// removed, so every revision of a schedule has a marker queue holding a token for each
+// message, and workers drop the copies which find no token left, whichever process they run in.
+// Cancel and Reschedule take the tokens of the current revision away
+type schedule struct {
+	// messages are kept to be published again by Reschedule until they are due
+	messages []interface{}
+	// revision of the copies which should be delivered
+	rev int32
+	// due time of the current revision
+	due time.Time
+	// latest due time of all the published revisions
+	latest time.Time
+
+	cancelled bool
+}
+
+func (q *Queue) At(t time.Time, messages ...interface{}) (string, error) {
+
+	id := internal.RandomString(16)
+	if err := q.publishScheduled(id, 0, t, messages); err != nil {
+		// the copies published so far are dropped
+		_, purgeErr := q.purgeMarker(id, 0)
+		logger.LogIfError(purgeErr)
+		return "", err
+	}
+
+	q.schedMu.Lock()
+	q.collectSchedules()
+	q.schedules[id] = &schedule{messages: messages, due: t, latest: t}
+	q.schedMu.Unlock()
+
+	return id, nil
+}
+
+func (q *Queue) Cancel(id string) error {
+
+	q.schedMu.Lock()
+	defer q.schedMu.Unlock()
+
+	q.collectSchedules()
+	s, ok := q.schedules[id]
+	if !ok || s.cancelled {
+		return queue.ErrScheduleNotFound
+	}
+
+	n, err := q.purgeMarker(id, s.rev)
+	if err != nil {
+		return err
+	}
+
+	s.cancelled = true
+	s.messages = nil
+
+	// all the messages have been delivered
+	if n == 0 {
+		return queue.ErrScheduleNotFound
+	}
+
+	return nil
+}
+
+func (q *Queue) Reschedule(id string, t time.Time) error {
+
+	q.schedMu.Lock()
+	defer q.schedMu.Unlock()
+
+	q.collectSchedules()
+	s, ok := q.schedules[id]
+	// the messages are released once they are due, they may have been delivered
+	if !ok || s.cancelled || s.messages == nil {
+		return queue.ErrScheduleNotFound
+	}
+
+	rev := s.rev + 1
+	if err := q.publishScheduled(id, rev, t, s.messages); err != nil {
+		// the previous copies are still valid
+		_, purgeErr := q.purgeMarker(id, rev)
+		logger.LogIfError(purgeErr)
+		return err
+	}
+
+	n, err := q.purgeMarker(id, s.rev)
+	if err == nil && n < len(s.messages) {
+		// some of the messages have been delivered meanwhile,
+		// the tokens of the others are put back so that they are still delivered
+		if n > 0 {
+			err = q.putTokens(q.marker(id, s.rev), n)
+		}
+		if err == nil {
+			err = queue.ErrScheduleNotFound
+		}
+	}
+	if err != nil {
+		_, purgeErr := q.purgeMarker(id, rev)
+		logger.LogIfError(purgeErr)
+		return err
+	}
+
+	s.rev = rev
+	s.due = t
+	if t.After(s.latest) {
+		s.latest = t
+	}
+
+	return nil
+}
+
+func (q *Queue) publishScheduled(id string, rev int32, t time.Time, messages []interface{}) error {
+
+	// the tokens are in place before any copy can arrive
+	if err := q.declareMarker(id, rev, t, len(messages)); err != nil {
+		return err
+	}
+
+	envelopes := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		body, props := queue.Unwrap(msg)
+
+		headers := make(map[string]interface{}, len(props.Headers)+2)
+		for k, v := range props.Headers {
+			headers[k] = v
+		}
+		headers[scheduleIDHeader] = id
+		headers[scheduleRevHeader] = rev
+		props.Headers = headers
+
+		envelopes[i] = &queue.Envelope{Properties: props, Body: body}
+	}
+
+	return q.later(time.Until(t), envelopes...)
+}
+
+// marker returns the name of the marker queue of the schedule revision
+func (q *Queue) marker(id string, rev int32) string {
+	return q.name + ".schedule." + id + "." + strconv.Itoa(int(rev))
+}
+
+// declareMarker declares the marker queue of the schedule revision with a token for each message,
+// it expires once the messages are due and the retention has passed
+func (q *Queue) declareMarker(id string, rev int32, t time.Time, n int) error {
+	expires := time.Until(t)
+	if expires < 0 {
+		expires = 0
+	}
+	expires += scheduleRetention
+
+	err := q.channels().with(func(ch *pooledChannel) error {
+		_, err := ch.QueueDeclare(
+			q.marker(id, rev), // name
+			true,              // durable
+			false,             // delete when unused
+			false,             // exclusive
+			false,             // no wait
+			amqp.Table{"x-expires": expires.Milliseconds()}, // arguments
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return q.putTokens(q.marker(id, rev), n)
+}
+
+// putTokens publishes n tokens to the marker queue, they are enqueued when it returns
+func (q *Queue) putTokens(marker string, n int) error {
+	return q.channels().with(func(ch *pooledChannel) error {
+		var batch []*publishing
+		for i := 0; i < n; i++ {
+			m, err := ch.pub.publish("", marker, false, amqp.Publishing{DeliveryMode: amqp.Persistent})
+			if err != nil {
+				return err
+			}
+			if m != nil {
+				batch = append(batch, m)
+			}
+		}
+
+		for _, m := range batch {
+			if err := m.wait(q.opt.ConfirmTimeout); err != nil {
+				return err
+			}
+		}
+
+		// the methods of a channel are handled in order,
+		// so the tokens are enqueued once the inspection returns
+		_, err := ch.QueueInspect(marker)
+		return err
+	})
+}
+
+// purgeMarker takes the tokens of the schedule revision away, it returns the number of
+// tokens left, which is 0 if the marker queue no longer exists
+func (q *Queue) purgeMarker(id string, rev int32) (int, error) {
+	var n int
+	err := q.channels().with(func(ch *pooledChannel) error {
+		var err error
+		n, err = ch.QueuePurge(q.marker(id, rev), false)
+		return err
+	})
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.NotFound {
+		return 0, nil
+	}
+
+	return n, err
+}
+
+// dropScheduled reports whether the delivery is a cancelled or stale scheduled message,
+// the delivery takes a token of its schedule revision if there is one left
+func (q *Queue) dropScheduled(d amqp.Delivery) bool {
+
+	id, ok := d.Headers[scheduleIDHeader].(string)
+	if !ok {
+		return false
+	}
+	// the token is taken by the first delivery, e.g. before the message is rejected
+	if d.Redelivered {
+		return false
+	}
+	rev, _ := d.Headers[scheduleRevHeader].(int32)
+
+	var taken bool
+	err := q.channels().with(func(ch *pooledChannel) error {
+		var err error
+		_, taken, err = ch.Get(q.marker(id, rev), true)
+		return err
+	})
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.NotFound {
+		// the marker has expired, or the message is published without one by an earlier version
+		return false
+	}
+	if err != nil {
+		// delivering a stale copy is better than losing the message
+		logger.Warnf("rabbitmq: check scheduled message %s error: %s", id, err)
+		return false
+	}
+
+	return !taken
+}
+
+// collectSchedules releases the messages which are due and removes the schedules
+// past their retention. The caller must hold schedMu
+func (q *Queue) collectSchedules() {
+	now := time.Now()
+	for id, s := range q.schedules {
+		if now.Sub(s.latest) > scheduleRetention {
+			delete(q.schedules, id)
+			continue
+		}
+
+		if !now.Before(s.due) {
+			s.messages = nil
+		}
+	}
+}
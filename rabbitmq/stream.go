@@ -0,0 +1,50 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/streadway/amqp"
+)
+
+// StreamOffsetHeader is the header of the messages consumed from a stream, holding their offset
+const StreamOffsetHeader = "x-stream-offset"
+
+// streamOffset returns the x-stream-offset consumer argument of the offset
+func streamOffset(offset queue.Offset) interface{} {
+	switch offset.Kind {
+	case queue.OffsetFirst:
+		return "first"
+	case queue.OffsetLast:
+		return "last"
+	case queue.OffsetAt:
+		return offset.Value
+	case queue.OffsetTimestamp:
+		return offset.Timestamp
+	}
+
+	return "next"
+}
+
+// streamOffsetOf returns the offset of a delivery from a stream
+func streamOffsetOf(d amqp.Delivery) (int64, bool) {
+	switch offset := d.Headers[StreamOffsetHeader].(type) {
+	case int64:
+		return offset, true
+	case int32:
+		return int64(offset), true
+	}
+
+	return 0, false
+}
+
+// maxAge formats the x-max-age of a stream in seconds, the smallest unit accepted
+func maxAge(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return fmt.Sprintf("%ds", seconds)
+}
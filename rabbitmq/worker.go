@@ -4,23 +4,74 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ibllex/go-queue"
+	"github.com/streadway/amqp"
 )
 
+var errDeliveriesClosed = errors.New("deliveries closed")
+
+// ErrCancelled is returned by Worker.Daemon when its consumer is cancelled by the broker
+// because the queue is deleted
+var ErrCancelled = errors.New("rabbitmq: consumer is cancelled, the queue is deleted")
+
+// errCancelled is returned by consume when the broker cancels the consumer,
+// e.g. the queue is deleted or its leader is moved to another node
+var errCancelled = errors.New("consumer cancelled")
+
 type Worker struct {
 	id string
 	q  *Queue
 
 	opt *queue.ConsumerOption
+	// from is where a stream is read, it moves past the delivered messages
+	// so that a resubscribed consumer does not replay them
+	from queue.Offset
 }
 
 func (w *Worker) Name() string {
 	return w.q.name
 }
 
+// Daemon consumes the queue until ctx is done, the consumer is resubscribed
+// when its channel is closed, it is cancelled by the broker or the connection is recovered
 func (w *Worker) Daemon(ctx context.Context, handler queue.HandlerFunc) error {
-	ch, err := w.q.conn.Channel()
+
+	for {
+		conn := w.q.connection()
+		err := w.consume(ctx, conn, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if !conn.IsClosed() {
+			switch err {
+			case errDeliveriesClosed:
+				// only the channel is closed
+				continue
+			case errCancelled:
+				if err = w.resubscribable(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		if !w.q.recoverable() {
+			return errors.New("queue connection closed")
+		}
+
+		if err = w.q.waitReconnected(ctx.Done(), conn); err != nil {
+			return err
+		}
+	}
+
+}
+
+func (w *Worker) consume(ctx context.Context, conn *amqp.Connection, handler queue.HandlerFunc) error {
+	ch, err := conn.Channel()
 	if err != nil {
 		return fmt.Errorf("create channel error: %s", err)
 	}
@@ -31,6 +82,11 @@ func (w *Worker) Daemon(ctx context.Context, handler queue.HandlerFunc) error {
 		return fmt.Errorf("channel qos error: %s", err)
 	}
 
+	var args amqp.Table
+	if w.q.opt.QueueType == QueueStream {
+		args = amqp.Table{StreamOffsetHeader: streamOffset(w.from)}
+	}
+
 	deliveries, err := ch.Consume(
 		w.q.name, // queue
 		w.id,     // consumer
@@ -38,27 +94,68 @@ func (w *Worker) Daemon(ctx context.Context, handler queue.HandlerFunc) error {
 		false,    // exclusive
 		false,    // noLocal
 		false,    // noWait
-		nil,      // arguments,
+		args,     // arguments,
 	)
 
 	if err != nil {
 		return fmt.Errorf("queue consume error: %s", err)
 	}
 
+	// the cancellation is notified before the deliveries are closed
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ch.Close()
-		case d := <-deliveries:
-			if w.q.conn.IsClosed() {
-				return errors.New("queue connection closed")
+		case d, ok := <-deliveries:
+			if !ok {
+				// the cancellations are closed with the channel
+				if _, cancelled := <-cancels; cancelled {
+					// the unacked messages are requeued by closing the channel
+					ch.Close()
+					return errCancelled
+				}
+				return errDeliveriesClosed
+			}
+			if ctx.Err() != nil {
+				// stopped while the message was waiting, it is requeued by closing the channel
+				return ch.Close()
 			}
-			handler(NewMessage(d, w.q.opt.Codec))
+			if offset, ok := streamOffsetOf(d); ok {
+				w.from = queue.FromOffset(offset + 1)
+			}
+			if w.q.dropScheduled(d) {
+				d.Ack(false)
+				continue
+			}
+			m := NewMessage(d, w.q.codecOf(d))
+			m.q = w.q
+			handler(m)
 		}
 	}
+}
+
+// resubscribable waits before resubscribing a cancelled consumer,
+// it returns ErrCancelled if the queue no longer exists
+func (w *Worker) resubscribable(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(w.q.opt.ReconnectDelay):
+	}
+
+	err := w.q.channels().with(func(ch *pooledChannel) error {
+		_, err := w.q.declareQueue(ch, true)
+		return err
+	})
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.NotFound {
+		return ErrCancelled
+	}
 
+	return err
 }
 
 func NewWorker(id string, q *Queue, opt *queue.ConsumerOption) *Worker {
-	return &Worker{id: id, q: q, opt: opt}
+	return &Worker{id: id, q: q, opt: opt, from: opt.StartFrom}
 }
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/ibllex/go-queue/internal"
+	"github.com/ibllex/go-queue/internal/logger"
+)
+
+// Router distributes messages to handlers according to
+// the message type recorded by Dispatch at publish time
+type Router struct {
+	handlers sync.Map
+
+	mu       sync.RWMutex
+	fallback Handler
+}
+
+// Register the handler for messages of the same type as value,
+// value must be of the same type as the dispatched messages (pointer or not)
+func (r *Router) Register(value interface{}, handler Handler) {
+	r.RegisterName(internal.NameOf(value), handler)
+}
+
+// RegisterName register the handler for messages of the given type name
+func (r *Router) RegisterName(name string, handler Handler) {
+	if name == "" {
+		// reserved for untyped messages
+		panic("attempt to register empty name")
+	}
+
+	if handler == nil {
+		panic("attempt to register nil handler")
+	}
+
+	r.handlers.Store(name, handler)
+}
+
+// Fallback set the handler for messages of unknown or missing type
+func (r *Router) Fallback(handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallback = handler
+}
+
+// Get returns the handler for the given type name
+func (r *Router) Get(name string) Handler {
+	if v, ok := r.handlers.Load(name); ok {
+		return v.(Handler)
+	}
+
+	return nil
+}
+
+// Handle implements Handler
+func (r *Router) Handle(m Message) {
+	name := PropertiesOf(m).Type
+
+	if handler := r.Get(name); handler != nil {
+		handler.Handle(m)
+		return
+	}
+
+	r.mu.RLock()
+	fallback := r.fallback
+	r.mu.RUnlock()
+
+	if fallback != nil {
+		fallback.Handle(m)
+		return
+	}
+
+	logger.Errorf("unsupport message type: %s", name)
+	logger.LogIfError(m.Ack())
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
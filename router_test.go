@@ -0,0 +1,100 @@
+package queue_test
+
+import (
+	"testing"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/memq"
+	"github.com/stretchr/testify/assert"
+)
+
+const routerRoute = "router"
+
+type SignUpEvent struct {
+	User string
+}
+
+type OrderEvent struct {
+	ID int
+}
+
+func TestRouter(t *testing.T) {
+	var users []string
+	var orders []int
+	var unknown int
+
+	r := queue.NewRouter()
+	r.Register(&SignUpEvent{}, queue.H(func(m queue.Message) {
+		var e SignUpEvent
+		assert.Nil(t, m.Unmarshal(&e))
+		users = append(users, e.User)
+		m.Ack()
+	}))
+	r.Register(&OrderEvent{}, queue.H(func(m queue.Message) {
+		var e OrderEvent
+		assert.Nil(t, m.Unmarshal(&e))
+		orders = append(orders, e.ID)
+		m.Ack()
+	}))
+
+	assert.Panics(t, func() {
+		r.RegisterName("", queue.H(func(m queue.Message) {}))
+	})
+
+	q, _ := memq.NewQueue(routerRoute, memq.WithSync(r))
+	queue.Add(q)
+
+	opt := &queue.DispatchOption{Queue: routerRoute}
+	assert.Nil(t, queue.Dispatch(opt, &SignUpEvent{User: "jude"}, &OrderEvent{ID: 1}))
+	assert.Equal(t, []string{"jude"}, users)
+	assert.Equal(t, []int{1}, orders)
+
+	t.Run("without fallback", func(t *testing.T) {
+		assert.Nil(t, queue.Dispatch(opt, "unknown"))
+		assert.Equal(t, 0, unknown)
+	})
+
+	t.Run("with fallback", func(t *testing.T) {
+		r.Fallback(queue.H(func(m queue.Message) {
+			unknown++
+			m.Ack()
+		}))
+
+		assert.Nil(t, queue.Dispatch(opt, "unknown"))
+		assert.Nil(t, q.Publish(&SignUpEvent{User: "untyped"}))
+		assert.Equal(t, 2, unknown)
+		assert.Equal(t, []string{"jude"}, users)
+	})
+
+	t.Run("fallback set while consuming", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				r.Fallback(queue.H(func(m queue.Message) {
+					m.Ack()
+				}))
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, queue.Dispatch(opt, "unknown"))
+		}
+		<-done
+	})
+
+	t.Run("explicit type", func(t *testing.T) {
+		r.RegisterName("order.created", queue.H(func(m queue.Message) {
+			var e OrderEvent
+			assert.Nil(t, m.Unmarshal(&e))
+			orders = append(orders, e.ID*10)
+			m.Ack()
+		}))
+
+		assert.Nil(t, queue.Dispatch(opt, &queue.Envelope{
+			Properties: queue.Properties{Type: "order.created"},
+			Body:       &OrderEvent{ID: 2},
+		}))
+		assert.Equal(t, []int{1, 20}, orders)
+	})
+}
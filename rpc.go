@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var ErrNoReplyTo = errors.New("message has no reply address")
+
+// Caller is implemented by queues that support request/reply
+type Caller interface {
+	// Call publishes the request and waits for the reply,
+	// which is decoded into resp, until the context is done
+	Call(ctx context.Context, req interface{}, resp interface{}) error
+}
+
+// Replier is implemented by messages that can be replied to
+type Replier interface {
+	Reply(v interface{}) error
+}
+
+// Call publishes the request to the named queue and waits for the reply,
+// use a context with deadline to limit the waiting time
+func Call(ctx context.Context, name string, req interface{}, resp interface{}) error {
+
+	q, err := Get(name)
+	if err != nil {
+		return err
+	}
+
+	c, ok := q.(Caller)
+	if !ok {
+		return fmt.Errorf("queue %s does not support request/reply", name)
+	}
+
+	return c.Call(ctx, envelope(req), resp)
+}
+
+// Reply sends v back to the caller of the message
+func Reply(m Message, v interface{}) error {
+	if r, ok := m.(Replier); ok {
+		return r.Reply(v)
+	}
+
+	return fmt.Errorf("message %s does not support reply", m.Name())
+}
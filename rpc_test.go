@@ -0,0 +1,77 @@
+package queue_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ibllex/go-queue"
+	"github.com/ibllex/go-queue/memq"
+	"github.com/stretchr/testify/assert"
+)
+
+const rpcRoute = "rpc"
+
+type SumRequest struct {
+	Numbers []int
+}
+
+type SumResponse struct {
+	Sum int
+}
+
+func TestCall(t *testing.T) {
+	q, _ := memq.NewQueue(rpcRoute)
+	queue.Add(q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := q.Consumer(&queue.ConsumerOption{
+		Handler: queue.H(func(m queue.Message) {
+			var req SumRequest
+			assert.Nil(t, m.Unmarshal(&req))
+
+			if len(req.Numbers) == 0 {
+				// leave the caller waiting
+				m.Ack()
+				return
+			}
+
+			var resp SumResponse
+			for _, n := range req.Numbers {
+				resp.Sum += n
+			}
+
+			assert.Nil(t, queue.Reply(m, &resp))
+			m.Ack()
+		}),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Start(ctx))
+
+	t.Run("reply", func(t *testing.T) {
+		var resp SumResponse
+		assert.Nil(t, queue.Call(ctx, rpcRoute, &SumRequest{Numbers: []int{1, 2, 3}}, &resp))
+		assert.Equal(t, 6, resp.Sum)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+
+		var resp SumResponse
+		err := queue.Call(ctx, rpcRoute, &SumRequest{}, &resp)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("unknown queue", func(t *testing.T) {
+		assert.NotNil(t, queue.Call(ctx, "unknown", &SumRequest{}, nil))
+	})
+}
+
+func TestReplyWithoutCaller(t *testing.T) {
+	q, _ := memq.NewQueue(rpcRoute)
+	msg := memq.NewMessage(q, 10)
+	assert.Equal(t, queue.ErrNoReplyTo, queue.Reply(msg, 20))
+}
@@ -127,10 +127,24 @@ func DispatchTaskName(name string, task interface{}) error {
 		}
 	}
 
+	if m := tv.MethodByName("Priority"); m.IsValid() {
+		if f, ok := m.Interface().(func() uint8); ok {
+			opt.Priority = f()
+		}
+	}
+
 	byts, err := taskCodec.Marshal(task)
 	if err != nil {
 		return err
 	}
 
+	if f := faking(); f != nil {
+		if opt.Queue == "" {
+			opt.Queue = defaultQueue
+		}
+		f.capture(opt, name, task, Properties{Type: name, Priority: opt.Priority})
+		return nil
+	}
+
 	return Dispatch(opt, &innerTask{Name: name, Data: byts})
 }
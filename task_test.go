@@ -1,6 +1,7 @@
 package queue_test
 
 import (
+	"context"
 	"sync/atomic"
 	"testing"
 
@@ -38,6 +39,38 @@ func TestRegisterTask(t *testing.T) {
 	})
 }
 
+type UrgentTask struct {
+	MockTask
+}
+
+func (t *UrgentTask) OnQueue() string {
+	return taskRoute + ".urgent"
+}
+
+func (t *UrgentTask) Priority() uint8 {
+	return 10
+}
+
+func TestDispatchPriority(t *testing.T) {
+	q, _ := memq.NewQueue(taskRoute + ".urgent")
+	queue.Add(q)
+	queue.RegisterTask(&UrgentTask{})
+
+	assert.Nil(t, queue.Dispatch(&queue.DispatchOption{Queue: q.Name(), Priority: 1}, "low"))
+	assert.Nil(t, queue.DispatchTask(&UrgentTask{}))
+
+	var priorities []uint8
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Daemon(ctx, func(m queue.Message) {
+		priorities = append(priorities, queue.PropertiesOf(m).Priority)
+		if len(priorities) == 2 {
+			cancel()
+		}
+	})
+
+	assert.Equal(t, []uint8{10, 1}, priorities)
+}
+
 func TestDispatch(t *testing.T) {
 	atomic.StoreInt32(&counter, 0)
 